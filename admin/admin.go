@@ -1,26 +1,56 @@
 package admin
 
 import (
+	"context"
 	"fmt"
 	"github.com/merisho/quest/commandbus"
-	"io"
+	"github.com/merisho/quest/transport"
 	"log"
+	"sort"
+	"strings"
 )
 
-func NewAdmin(userID string, cb *commandbus.CommandBus, out io.Writer) *Admin {
+// SendFailedCommand is published with the messages which could not be
+// delivered to the chat of the user, the reason goes in the "error" service data
+const SendFailedCommand = "sendfailed"
+
+// forwardsBuffer is how many commands wait for the admin
+const forwardsBuffer = 100
+
+// ReportFailedSend lets the admin know that the message was not delivered to the chat
+func ReportFailedSend(cb *commandbus.CommandBus, chatID, text string, err error) {
+	cb.Publish("/" + SendFailedCommand + " " + text, chatID, [2]string{"error", err.Error()})
+}
+
+func NewAdmin(userID string, cb *commandbus.CommandBus, out transport.Output) *Admin {
+	ctx, cancel := context.WithCancel(context.Background())
 	a := &Admin{
-		destroy: make(chan struct{}),
+		destroy: cancel,
 		out: out,
+		clueTiers: make(map[string]clueTier),
+		names: make(map[string]string),
 	}
-	onlyOtherUsers := func(c *commandbus.Command) bool {
+	// the admin asks for the clues itself, everything else comes from the players
+	fromPlayers := func(c *commandbus.Command) bool {
+		if c.Type == "clues" {
+			return c.UserID == userID
+		}
+
 		return c.UserID != userID
 	}
 
-	playerResponses := cb.FilterSubscribe("userres", onlyOtherUsers)
-	playerMsgs := cb.FilterSubscribe("", onlyOtherUsers)
-	playerAnswers := cb.FilterSubscribe("a", onlyOtherUsers)
+	// players must not wait for the admin, so the oldest forwards
+	// are dropped if the admin falls behind
+	policy := commandbus.Policy{
+		Delivery: commandbus.DropOldestDelivery,
+		Buffer: forwardsBuffer,
+		OnDrop: func(c *commandbus.Command, reason commandbus.DropReason) {
+			log.Printf("admin missed /%s of %s: %s", c.Type, c.UserID, reason)
+		},
+	}
 
-	a.forwards = a.combineIntoForwards(playerResponses, playerMsgs, playerAnswers)
+	types := commandbus.Types{"userres", "", "a", "cluetier", SendFailedCommand, "clues"}
+	a.forwards = a.prepareForwards(cb.SubscribeMatching(ctx, types, policy, fromPlayers))
 	a.handleForwards()
 
 	return a
@@ -28,33 +58,55 @@ func NewAdmin(userID string, cb *commandbus.CommandBus, out io.Writer) *Admin {
 
 type Admin struct {
 	forwards chan *commandbus.Command
-	destroy chan struct{}
-	out io.Writer
+	// destroy cancels the subscriptions of the admin
+	destroy context.CancelFunc
+	out transport.Output
+	clueTiers map[string]clueTier
+	names map[string]string
+}
+
+type clueTier struct {
+	mission string
+	tier string
+	tiers string
+}
+
+func (t clueTier) String() string {
+	return fmt.Sprintf("%s/%s of %s", t.tier, t.tiers, t.mission)
 }
 
 func (a *Admin) Destroy() {
-	close(a.destroy)
+	a.destroy()
 }
 
 func (a *Admin) Greeting() {
 	a.write("Hello, admin")
 }
 
-func (a *Admin) combineIntoForwards(playerRes, playerMsgs, playerAns chan *commandbus.Command) chan *commandbus.Command {
+// prepareForwards turns the commands into the forwards to the admin
+func (a *Admin) prepareForwards(cmds chan *commandbus.Command) chan *commandbus.Command {
 	f := make(chan *commandbus.Command)
 
+	// the subscription is closed once the admin is destroyed
 	go func() {
-		for {
-			select {
-			case c := <- playerRes:
-				f <- c
-			case c := <- playerMsgs:
-				f <- c
-			case c := <- playerAns:
+		defer close(f)
+
+		for c := range cmds {
+			switch c.Type {
+			case "", "a":
+				a.rememberName(c)
+				// live locations are updated too often to forward every update
+				if c.ServiceData["live"] == "" {
+					f <- c
+				}
+			case "cluetier":
+				f <- a.trackClueTier(c)
+			case SendFailedCommand:
+				f <- a.failedSend(c)
+			case "clues":
+				a.writeClueTiers()
+			default:
 				f <- c
-			case <- a.destroy:
-				close(a.forwards)
-				return
 			}
 		}
 	}()
@@ -65,20 +117,91 @@ func (a *Admin) combineIntoForwards(playerRes, playerMsgs, playerAns chan *comma
 func (a *Admin) handleForwards() {
 	go func() {
 		for c := range a.forwards {
-			msg := fmt.Sprintf("%s\n=====\n", c.ServiceData["senderName"])
+			if c.Type == "cluetier" || c.Type == SendFailedCommand {
+				a.write(c.Input)
+				continue
+			}
+
+			// player messages are forwarded as plain text, so only the responses
+			// of the bot can be formatted. The header is escaped, sender names are written by players
+			mode := transport.ParseMode(c.ServiceData["parseMode"])
+			header := c.ServiceData["senderName"] + "\n=====\n"
 			if c.Type == "a" {
-				msg += "!Answer: "
+				header += "!Answer: "
 			}
 
-			msg += c.Input
-			a.write(msg)
+			a.send(transport.Outgoing{
+				Text: transport.Escape(header, mode) + c.Input,
+				ParseMode: mode,
+				Kind: transport.ForwardMessage,
+			})
 		}
 	}()
 }
 
+func (a *Admin) rememberName(c *commandbus.Command) {
+	if name := c.ServiceData["senderName"]; name != "" {
+		a.names[c.UserID] = name
+	}
+}
+
+func (a *Admin) playerName(userID string) string {
+	if name, ok := a.names[userID]; ok {
+		return fmt.Sprintf("%s (%s)", name, userID)
+	}
+
+	return userID
+}
+
+// trackClueTier returns the notification about the clue to forward
+func (a *Admin) trackClueTier(c *commandbus.Command) *commandbus.Command {
+	t := clueTier{
+		mission: c.ServiceData["mission"],
+		tier: c.Input,
+		tiers: c.ServiceData["tiers"],
+	}
+	a.clueTiers[c.UserID] = t
+
+	return &commandbus.Command{
+		Type: c.Type,
+		Input: fmt.Sprintf("%s got clue %s", a.playerName(c.UserID), t),
+		UserID: c.UserID,
+	}
+}
+
+// failedSend returns the notification about the message the player did not get
+func (a *Admin) failedSend(c *commandbus.Command) *commandbus.Command {
+	return &commandbus.Command{
+		Type: c.Type,
+		Input: fmt.Sprintf("Could not deliver to %s: %s\n=====\n%s", a.playerName(c.UserID), c.ServiceData["error"], c.Input),
+		UserID: c.UserID,
+	}
+}
+
+func (a *Admin) writeClueTiers() {
+	if len(a.clueTiers) == 0 {
+		a.write("No clues were given yet")
+		return
+	}
+
+	var lines []string
+	for userID, t := range a.clueTiers {
+		lines = append(lines, fmt.Sprintf("%s: clue %s", a.playerName(userID), t))
+	}
+	sort.Strings(lines)
+
+	a.write(strings.Join(lines, "\n"))
+}
+
 func (a *Admin) write(msg string) {
-	_, err := a.out.Write([]byte(msg))
-	if err != nil {
+	a.send(transport.Outgoing{
+		Text: msg,
+		Kind: transport.SystemMessage,
+	})
+}
+
+func (a *Admin) send(msg transport.Outgoing) {
+	if err := a.out.Send(msg); err != nil {
 		log.Println(err)
 	}
 }
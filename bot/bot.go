@@ -0,0 +1,152 @@
+package bot
+
+import (
+	"github.com/merisho/quest/admin"
+	"github.com/merisho/quest/commandbus"
+	"github.com/merisho/quest/quest"
+	"github.com/merisho/quest/session"
+	"github.com/merisho/quest/transport"
+	"log"
+	"strconv"
+)
+
+const (
+	PlayerCommand = "philadelphia"
+	AdminCommand = "adminsecret"
+)
+
+func NewBot(t transport.Transport, cb *commandbus.CommandBus, sessions *session.Manager) *Bot {
+	return &Bot{
+		t: t,
+		cb: cb,
+		sessions: sessions,
+	}
+}
+
+// Bot dispatches the messages of a transport to the players,
+// the admin and the command bus
+type Bot struct {
+	t transport.Transport
+	cb *commandbus.CommandBus
+	sessions *session.Manager
+	admin *admin.Admin
+}
+
+// Run dispatches messages until the transport closes the channel of messages
+func (b *Bot) Run() {
+	for msg := range b.t.Messages() {
+		b.Dispatch(msg)
+	}
+}
+
+func (b *Bot) Dispatch(msg transport.Message) {
+	if msg.CallbackID != "" {
+		b.press(msg)
+		return
+	}
+
+	if msg.Location != nil {
+		b.shareLocation(msg)
+		return
+	}
+
+	switch msg.Command() {
+	case PlayerCommand:
+		if _, err := b.sessions.Restart(msg.ChatID, b.Out(msg.ChatID)); err != nil {
+			log.Println(err)
+		}
+		return
+	case AdminCommand:
+		if b.admin != nil {
+			b.admin.Destroy()
+		}
+
+		b.admin = admin.NewAdmin(msg.ChatID, b.cb, b.Out(msg.ChatID))
+		b.admin.Greeting()
+		return
+	}
+
+	b.cb.Publish(
+		msg.Text,
+		msg.ChatID,
+		[2]string{"senderName", msg.SenderName},
+		[2]string{"messageID", strconv.Itoa(msg.ID)},
+	)
+}
+
+// press answers the task with the choice of the pressed button. The player
+// ignores the answer if the button is of a task passed before
+func (b *Bot) press(msg transport.Message) {
+	task, choice := quest.ParseChoice(msg.Text)
+
+	if a, ok := b.t.(transport.Acknowledger); ok {
+		if err := a.Acknowledge(msg, choice); err != nil {
+			log.Println(err)
+		}
+	}
+
+	b.cb.Publish(
+		"/a " + choice,
+		msg.ChatID,
+		[2]string{"senderName", msg.SenderName},
+		[2]string{"messageID", strconv.Itoa(msg.ID)},
+		[2]string{"task", task},
+	)
+}
+
+// shareLocation answers the task with the location. The text of
+// the answer is only for the admin to see
+func (b *Bot) shareLocation(msg transport.Message) {
+	cmd := &commandbus.Command{
+		Type: "a",
+		Input: msg.Location.String(),
+		UserID: msg.ChatID,
+		ServiceData: map[string]string{
+			"senderName": msg.SenderName,
+			"messageID": strconv.Itoa(msg.ID),
+		},
+		Location: &commandbus.Location{
+			Latitude: msg.Location.Latitude,
+			Longitude: msg.Location.Longitude,
+		},
+	}
+	if msg.Live {
+		cmd.ServiceData["live"] = "true"
+	}
+
+	b.cb.PublishCommand(cmd)
+}
+
+// Out is the output to the chat. Everything sent to the chat
+// is republished as /userres, so the admin sees what players receive
+func (b *Bot) Out(chatID string) transport.Output {
+	return &out{
+		chatID: chatID,
+		out: b.t.Output(chatID),
+		cb: b.cb,
+		botName: b.t.SelfName(),
+	}
+}
+
+type out struct {
+	chatID string
+	out transport.Output
+	cb *commandbus.CommandBus
+	botName string
+}
+
+func (o *out) Send(msg transport.Outgoing) error {
+	if err := o.out.Send(msg); err != nil {
+		return err
+	}
+
+	o.cb.Publish(
+		"/userres " + msg.String(),
+		o.chatID,
+		[2]string{"senderName", o.botName},
+		[2]string{"parseMode", string(msg.ParseMode)},
+		[2]string{"kind", string(msg.Kind)},
+	)
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package bot
+
+import (
+	"bytes"
+	"github.com/merisho/quest/commandbus"
+	"github.com/merisho/quest/player"
+	"github.com/merisho/quest/quest"
+	"github.com/merisho/quest/session"
+	"github.com/merisho/quest/storage"
+	"github.com/merisho/quest/transport"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type syncBuffer struct {
+	mu sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func newConsoleBot(t *testing.T) (*io.PipeWriter, *syncBuffer) {
+	in, w := io.Pipe()
+	out := &syncBuffer{}
+	cb := commandbus.NewCommandBus()
+
+	sessions := session.NewManager(func(userID string, out transport.Output, snap *storage.Snapshot) (*player.Player, error) {
+		q, err := quest.NewQuestFromFile("./test-quest.json", out)
+		if err != nil {
+			return nil, err
+		}
+
+		return player.NewPlayer(player.Config{UserID: userID}, cb, q, out), nil
+	})
+
+	b := NewBot(transport.NewConsole(in, out), cb, sessions)
+	go b.Run()
+
+	t.Cleanup(func() {
+		w.Close()
+		sessions.DestroyAll()
+	})
+
+	return w, out
+}
+
+func send(w io.Writer, line string) {
+	io.WriteString(w, line + "\n")
+	time.Sleep(20 * time.Millisecond)
+}
+
+func TestPlayThroughConsole(t *testing.T) {
+	w, out := newConsoleBot(t)
+
+	send(w, "/" + PlayerCommand)
+	assert.Equal(t, "[1] Welcome to Mission 1\n[1] task 1\n", out.String())
+
+	send(w, "/a answer 1")
+	assert.True(t, strings.HasSuffix(out.String(), "[1] Welcome to Mission 2\n[1] task 2\n"), out.String())
+}
+
+func TestAdminSeesPlayers(t *testing.T) {
+	w, out := newConsoleBot(t)
+
+	send(w, "@2 /" + AdminCommand)
+	assert.Equal(t, "[2] Hello, admin\n", out.String())
+
+	send(w, "/" + PlayerCommand)
+	send(w, "hello")
+
+	assert.True(t, strings.Contains(out.String(), "[2] Quest Bot\n=====\ntask 1\n"), "admin must see what the player receives:\n" + out.String())
+	assert.True(t, strings.Contains(out.String(), "[2] Player 1\n=====\nhello\n"), "admin must see what the player sends:\n" + out.String())
+}
+
+func TestRestartDoesNotAffectOtherChats(t *testing.T) {
+	w, out := newConsoleBot(t)
+
+	send(w, "/" + PlayerCommand)
+	send(w, "@3 /" + PlayerCommand)
+	send(w, "/a answer 1")
+	send(w, "@3 /" + PlayerCommand)
+	send(w, "/a answer 2")
+
+	assert.True(t, strings.HasSuffix(out.String(), "[3] task 1\n"), out.String())
+	assert.False(t, strings.Contains(out.String(), "[3] task 2"), out.String())
+	assert.Equal(t, 2, strings.Count(out.String(), "[1] task"))
+}
+
+func TestPressButton(t *testing.T) {
+	w, out := newConsoleBot(t)
+
+	send(w, "@2 /" + AdminCommand)
+	send(w, "/" + PlayerCommand)
+	send(w, "[answer 1]")
+
+	assert.True(t, strings.Contains(out.String(), "[1] Welcome to Mission 2\n"), "button press must answer the task:\n" + out.String())
+	assert.True(t, strings.Contains(out.String(), "[2] Player 1\n=====\n!Answer: answer 1\n"), "admin must see the pressed button:\n" + out.String())
+}
@@ -0,0 +1,102 @@
+package commandbus
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// latency measures the time from publishing a command to reading it
+type latency struct {
+	total int64
+	count int64
+}
+
+func (l *latency) read(sub Subscription, delay time.Duration) {
+	for cmd := range sub {
+		sent, _ := strconv.ParseInt(cmd.ServiceData["sent"], 10, 64)
+		atomic.AddInt64(&l.total, time.Now().UnixNano() - sent)
+		atomic.AddInt64(&l.count, 1)
+		time.Sleep(delay)
+	}
+}
+
+// wait waits until the number of commands are read
+func (l *latency) wait(count int) {
+	for atomic.LoadInt64(&l.count) < int64(count) {
+		time.Sleep(100 * time.Microsecond)
+	}
+}
+
+func (l *latency) report(b *testing.B, unit string) {
+	if count := atomic.LoadInt64(&l.count); count > 0 {
+		b.ReportMetric(float64(atomic.LoadInt64(&l.total) / count), unit)
+	}
+}
+
+// benchmarkPublish publishes answers of the players in parallel while every player
+// reads its own answers and an observer reads all of them, like the admin does.
+// An operation lasts until the players read all the answers
+func benchmarkPublish(b *testing.B, players int, observer Policy, observerDelay time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cb := NewCommandBus()
+	var delivered, published latency
+
+	users := make([]string, players)
+	for i := range users {
+		userID := fmt.Sprintf("user-%d", i)
+		users[i] = userID
+
+		sub := cb.FilterSubscribeWith(ctx, "a", Policy{Delivery: UnboundedDelivery}, func(cmd *Command) bool {
+			return cmd.UserID == userID
+		})
+		go delivered.read(sub, 0)
+	}
+
+	go new(latency).read(cb.SubscribeWith(ctx, "a", observer), observerDelay)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		for pb.Next() {
+			start := time.Now()
+			cb.PublishCommand(&Command{
+				Type: "a",
+				UserID: users[r.Intn(players)],
+				Input: "answer",
+				ServiceData: map[string]string{"sent": strconv.FormatInt(time.Now().UnixNano(), 10)},
+			})
+			atomic.AddInt64(&published.total, int64(time.Since(start)))
+			atomic.AddInt64(&published.count, 1)
+		}
+	})
+	delivered.wait(b.N)
+	b.StopTimer()
+
+	published.report(b, "ns/publish")
+	delivered.report(b, "ns/delivery")
+}
+
+func BenchmarkPublish(b *testing.B) {
+	for _, players := range []int{10, 100, 500} {
+		b.Run(fmt.Sprintf("players=%d", players), func(b *testing.B) {
+			benchmarkPublish(b, players, DefaultPolicy, 0)
+		})
+	}
+}
+
+// BenchmarkPublishSlowObserver shows the players do not wait for an observer
+// which reads a command per millisecond and drops what it cannot keep up with
+func BenchmarkPublishSlowObserver(b *testing.B) {
+	for _, players := range []int{10, 100, 500} {
+		b.Run(fmt.Sprintf("players=%d", players), func(b *testing.B) {
+			benchmarkPublish(b, players, Policy{Delivery: DropOldestDelivery, Buffer: 100}, time.Millisecond)
+		})
+	}
+}
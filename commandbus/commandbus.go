@@ -1,20 +1,29 @@
 package commandbus
 
 import (
+	"context"
 	"strings"
+	"sync"
 )
 
 type CommandType string
 type Subscription chan *Command
 
 func NewCommandBus() *CommandBus {
+	subs := NewSubscriptionsMap()
+
 	return &CommandBus{
-		subs: NewSubscriptionsMap(),
+		subs: subs,
+		publish: subs.Send,
 	}
 }
 
 type CommandBus struct {
 	subs *SubscriptionsMap
+	mu sync.RWMutex
+	middlewares []Middleware
+	// publish passes the commands through the middlewares to the subscriptions
+	publish Handler
 }
 
 func (cb *CommandBus) SubscriptionsCount(cmdType CommandType) int {
@@ -22,23 +31,41 @@ func (cb *CommandBus) SubscriptionsCount(cmdType CommandType) int {
 }
 
 func (cb *CommandBus) Subscribe(cmdType CommandType) chan *Command {
-	sub := cb.subs.Create(cmdType)
-	return sub
+	return cb.SubscribeContext(context.Background(), cmdType)
+}
+
+// SubscribeContext is Subscribe which ends with the context. Once the context is done
+// the subscription is removed and the channel is closed
+func (cb *CommandBus) SubscribeContext(ctx context.Context, cmdType CommandType) chan *Command {
+	return cb.SubscribeWith(ctx, cmdType, DefaultPolicy)
+}
+
+// SubscribeWith is SubscribeContext with the policy of delivery of the commands
+func (cb *CommandBus) SubscribeWith(ctx context.Context, cmdType CommandType, policy Policy) chan *Command {
+	return cb.subs.Create(ctx, cmdType, policy, nil)
 }
 
 func (cb *CommandBus) FilterSubscribe(cmdType CommandType, filter func(*Command) bool) chan *Command {
-	filteredSub := make(chan *Command)
-	sub := cb.Subscribe(cmdType)
-
-	go func() {
-		for cmd := range sub {
-			if filter(cmd) {
-				filteredSub <- cmd
-			}
-		}
-	}()
+	return cb.FilterSubscribeContext(context.Background(), cmdType, filter)
+}
 
-	return filteredSub
+// FilterSubscribeContext is FilterSubscribe which ends with the context. Once the context
+// is done the subscription is removed and the channel is closed
+func (cb *CommandBus) FilterSubscribeContext(ctx context.Context, cmdType CommandType, filter func(*Command) bool) chan *Command {
+	return cb.FilterSubscribeWith(ctx, cmdType, DefaultPolicy, filter)
+}
+
+// FilterSubscribeWith is FilterSubscribeContext with the policy of delivery of the commands.
+// The filter is applied by the bus before the policy, so filtered out commands are never dropped.
+// It must be fast since the bus waits for it
+func (cb *CommandBus) FilterSubscribeWith(ctx context.Context, cmdType CommandType, policy Policy, filter func(*Command) bool) chan *Command {
+	return cb.subs.Create(ctx, cmdType, policy, filter)
+}
+
+// SubscribeMatching subscribes to the commands of all the types the matcher selects,
+// like AllTypes, a namespace such as "admin.*" or Types. A nil filter passes all commands
+func (cb *CommandBus) SubscribeMatching(ctx context.Context, match Matcher, policy Policy, filter func(*Command) bool) chan *Command {
+	return cb.subs.Create(ctx, match, policy, filter)
 }
 
 func (cb *CommandBus) Publish(text, userID string, serviceData ...[2]string) {
@@ -56,7 +83,17 @@ func (cb *CommandBus) Publish(text, userID string, serviceData ...[2]string) {
 
 	cmd.ServiceData = data
 
-	cb.subs.Send(cmd)
+	cb.PublishCommand(cmd)
+}
+
+// PublishCommand sends the command as is, for commands which
+// carry more than text, like shared locations
+func (cb *CommandBus) PublishCommand(cmd *Command) {
+	if cmd.ServiceData == nil {
+		cmd.ServiceData = make(map[string]string)
+	}
+
+	cb.handler()(cmd)
 }
 
 func (cb *CommandBus) Parse(text string) *Command {
@@ -92,4 +129,31 @@ type Command struct {
 	Args []string
 	UserID string
 	ServiceData map[string]string
+	// Location is set when the command is a shared location
+	Location *Location
+}
+
+// Copy returns a copy of the command which can be changed apart from the original
+func (c *Command) Copy() *Command {
+	cp := *c
+	cp.Args = append([]string(nil), c.Args...)
+
+	if c.ServiceData != nil {
+		cp.ServiceData = make(map[string]string, len(c.ServiceData))
+		for k, v := range c.ServiceData {
+			cp.ServiceData[k] = v
+		}
+	}
+
+	if c.Location != nil {
+		l := *c.Location
+		cp.Location = &l
+	}
+
+	return &cp
+}
+
+type Location struct {
+	Latitude float64
+	Longitude float64
 }
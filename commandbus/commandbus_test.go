@@ -1,7 +1,12 @@
 package commandbus
 
 import (
+	"context"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -69,11 +74,14 @@ func TestDanglingSubscription(t *testing.T) {
 	select {
 	case c := <- sub2:
 		assert.Equal(t, "user-id", c.UserID)
-	case <- time.After(50 * time.Millisecond):
+	case <- time.After(10 * time.Millisecond):
 		assert.Fail(t, "sends to subscriptions are blocked")
 	}
 
-	assert.Equal(t, 1, cb.SubscriptionsCount("test"), "must remove first subscription which is dangling")
+	// subscribers are served concurrently, the dangling one is removed after its timeout
+	assert.Eventually(t, func() bool {
+		return cb.SubscriptionsCount("test") == 1
+	}, 50 * time.Millisecond, time.Millisecond, "must remove first subscription which is dangling")
 }
 
 func TestFilterSubscribe(t *testing.T) {
@@ -121,3 +129,525 @@ func TestIgnoreEmptyCommand(t *testing.T) {
 	case <- time.After(10 * time.Millisecond):
 	}
 }
+
+func TestPublishCommand(t *testing.T) {
+	cb := NewCommandBus()
+
+	sub := cb.Subscribe("a")
+
+	time.AfterFunc(0, func() {
+		cb.PublishCommand(&Command{
+			Type: "a",
+			UserID: "user-id",
+			Location: &Location{Latitude: 55.7539, Longitude: 37.6208},
+		})
+	})
+
+	cmd := <- sub
+	assert.Equal(t, &Location{Latitude: 55.7539, Longitude: 37.6208}, cmd.Location)
+	assert.NotNil(t, cmd.ServiceData)
+}
+
+func TestSubscribeContext(t *testing.T) {
+	cb := NewCommandBus()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sub := cb.SubscribeContext(ctx, "test")
+	assert.Equal(t, 1, cb.SubscriptionsCount("test"))
+
+	cancel()
+
+	_, ok := <- sub
+	assert.False(t, ok, "must close the channel")
+	assert.Equal(t, 0, cb.SubscriptionsCount("test"), "must remove the subscription")
+}
+
+func TestCancelledSubscriptionDoesNotBlockPublish(t *testing.T) {
+	cb := NewCommandBus()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cb.SubscribeContext(ctx, "test")
+	sub := cb.Subscribe("test")
+	cancel()
+
+	start := time.Now()
+	go cb.Publish("/test command", "user-id")
+
+	<- sub
+	assert.True(t, time.Since(start) < 20 * time.Millisecond, "must not wait for the cancelled subscription")
+}
+
+func TestFilterSubscribeContext(t *testing.T) {
+	cb := NewCommandBus()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sub := cb.FilterSubscribeContext(ctx, "test", func(cmd *Command) bool {
+		return cmd.UserID == "user-1"
+	})
+
+	time.AfterFunc(0, func() {
+		cb.Publish("/test command", "user-1")
+	})
+	cmd := <- sub
+	assert.Equal(t, "user-1", cmd.UserID)
+
+	cancel()
+
+	_, ok := <- sub
+	assert.False(t, ok, "must close the channel")
+	assert.Equal(t, 0, cb.SubscriptionsCount("test"))
+}
+
+func TestCancelledSubscriptionsDoNotLeak(t *testing.T) {
+	cb := NewCommandBus()
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	for i := 0; i < 100; i++ {
+		cb.SubscribeContext(ctx, "test")
+		cb.FilterSubscribeContext(ctx, "test", func(*Command) bool {
+			return true
+		})
+		cb.SubscribeWith(ctx, "test", Policy{Delivery: UnboundedDelivery})
+	}
+	assert.True(t, runtime.NumGoroutine() > before)
+
+	// the filtering goroutines are stuck sending the command nobody reads
+	cb.Publish("/test command", "user-id")
+	cancel()
+
+	assert.True(t, waitGoroutines(before, time.Second), "must stop all the goroutines of the subscriptions")
+	assert.Equal(t, 0, cb.SubscriptionsCount("test"))
+}
+
+type drops struct {
+	mu sync.Mutex
+	cmds []string
+	reasons []DropReason
+}
+
+func (d *drops) add(cmd *Command, reason DropReason) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.cmds = append(d.cmds, cmd.Input)
+	d.reasons = append(d.reasons, reason)
+}
+
+func (d *drops) get() ([]string, []DropReason) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.cmds, d.reasons
+}
+
+func TestBlockDelivery(t *testing.T) {
+	cb := NewCommandBus()
+	d := &drops{}
+
+	evicted := cb.SubscribeWith(context.Background(), "test", Policy{
+		Delivery: BlockDelivery,
+		Timeout: 10 * time.Millisecond,
+		OnDrop: d.add,
+	})
+	patient := cb.SubscribeWith(context.Background(), "test", Policy{Delivery: BlockDelivery})
+
+	go cb.Publish("/test 1", "user-id")
+
+	time.Sleep(50 * time.Millisecond)
+	cmd := <- patient
+	assert.Equal(t, "1", cmd.Input, "must wait for the subscriber without timeout")
+
+	cmds, reasons := d.get()
+	assert.Equal(t, []string{"1"}, cmds)
+	assert.Equal(t, []DropReason{SubscriberEvicted}, reasons)
+
+	_, ok := <- evicted
+	assert.False(t, ok, "evicted subscription must be closed")
+	assert.Equal(t, 1, cb.SubscriptionsCount("test"))
+}
+
+func TestDropOldestDelivery(t *testing.T) {
+	cb := NewCommandBus()
+	d := &drops{}
+
+	sub := cb.SubscribeWith(context.Background(), "test", Policy{
+		Delivery: DropOldestDelivery,
+		Buffer: 2,
+		OnDrop: d.add,
+	})
+
+	for _, n := range []string{"1", "2", "3", "4", "5"} {
+		cb.Publish("/test " + n, "user-id")
+		time.Sleep(time.Millisecond)
+	}
+
+	// the first command is already being delivered when the rest come
+	var received []string
+	for i := 0; i < 3; i++ {
+		received = append(received, (<- sub).Input)
+	}
+	assert.Equal(t, []string{"1", "4", "5"}, received)
+
+	cmds, reasons := d.get()
+	assert.Equal(t, []string{"2", "3"}, cmds)
+	assert.Equal(t, []DropReason{OldestDropped, OldestDropped}, reasons)
+	assert.Equal(t, 1, cb.SubscriptionsCount("test"), "must not evict the subscriber")
+}
+
+func TestDropOldestDeliveryWithoutBuffer(t *testing.T) {
+	cb := NewCommandBus()
+	d := &drops{}
+
+	sub := cb.SubscribeWith(context.Background(), "test", Policy{
+		Delivery: DropOldestDelivery,
+		OnDrop: d.add,
+	})
+
+	// the first command is taken by the idle pump, there is no room for the rest
+	for _, n := range []string{"1", "2", "3"} {
+		cb.Publish("/test " + n, "user-id")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, "1", (<- sub).Input, "must deliver to the waiting subscriber")
+
+	cmds, reasons := d.get()
+	assert.Equal(t, []string{"2", "3"}, cmds)
+	assert.Equal(t, []DropReason{NewestDropped, NewestDropped}, reasons)
+
+	time.Sleep(10 * time.Millisecond)
+	cb.Publish("/test 4", "user-id")
+	assert.Equal(t, "4", (<- sub).Input)
+
+	cmds, _ = d.get()
+	assert.Len(t, cmds, 2)
+}
+
+func TestUnboundedDelivery(t *testing.T) {
+	cb := NewCommandBus()
+
+	sub := cb.FilterSubscribeWith(context.Background(), "test", Policy{Delivery: UnboundedDelivery}, func(cmd *Command) bool {
+		return cmd.UserID == "user-1"
+	})
+
+	for i := 0; i < 100; i++ {
+		cb.Publish(fmt.Sprintf("/test %d", i), "user-1")
+		cb.Publish(fmt.Sprintf("/test %d", i), "user-2")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 100; i++ {
+		cmd := <- sub
+		assert.Equal(t, fmt.Sprint(i), cmd.Input)
+		assert.Equal(t, "user-1", cmd.UserID)
+	}
+
+	select {
+	case cmd := <- sub:
+		assert.Fail(t, "must filter the commands", cmd.UserID)
+	case <- time.After(10 * time.Millisecond):
+	}
+}
+
+func TestConcurrentDelivery(t *testing.T) {
+	cb := NewCommandBus()
+
+	slow := cb.SubscribeWith(context.Background(), "test", Policy{Delivery: BlockDelivery})
+	fast := cb.SubscribeWith(context.Background(), "test", Policy{Delivery: BlockDelivery})
+
+	start := time.Now()
+	cb.Publish("/test command", "user-id")
+
+	<- fast
+	assert.True(t, time.Since(start) < 10 * time.Millisecond, "must not wait for the other subscriber")
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, "command", (<- slow).Input)
+}
+
+func TestSlowSubscriberOfOtherUser(t *testing.T) {
+	cb := NewCommandBus()
+
+	other := "user-2"
+	for i := 3; userShard(other) == userShard("user-1"); i++ {
+		other = fmt.Sprintf("user-%d", i)
+	}
+
+	onlyUser := func(userID string) func(*Command) bool {
+		return func(cmd *Command) bool {
+			return cmd.UserID == userID
+		}
+	}
+
+	// nobody reads the commands of user-1
+	cb.FilterSubscribeWith(context.Background(), "a", Policy{Delivery: BlockDelivery}, onlyUser("user-1"))
+	sub := cb.FilterSubscribeWith(context.Background(), "a", Policy{Delivery: BlockDelivery}, onlyUser(other))
+
+	cb.Publish("/a stuck", "user-1")
+	cb.Publish("/a answer", other)
+
+	select {
+	case cmd := <- sub:
+		assert.Equal(t, "answer", cmd.Input)
+	case <- time.After(50 * time.Millisecond):
+		assert.Fail(t, "must not wait for the subscriber of the other user")
+	}
+}
+
+func TestOrderOfUserCommands(t *testing.T) {
+	cb := NewCommandBus()
+	sub := cb.SubscribeWith(context.Background(), "test", Policy{Delivery: UnboundedDelivery})
+
+	const users, commands = 50, 100
+
+	var wg sync.WaitGroup
+	for u := 0; u < users; u++ {
+		wg.Add(1)
+		go func(userID string) {
+			defer wg.Done()
+			for i := 0; i < commands; i++ {
+				cb.Publish(fmt.Sprintf("/test %d", i), userID)
+			}
+		}(fmt.Sprintf("user-%d", u))
+	}
+	wg.Wait()
+
+	next := make(map[string]int)
+	for i := 0; i < users * commands; i++ {
+		cmd := <- sub
+		assert.Equal(t, fmt.Sprint(next[cmd.UserID]), cmd.Input, "commands of %s out of order", cmd.UserID)
+		next[cmd.UserID]++
+	}
+}
+
+func TestOrderAcrossSubscriptions(t *testing.T) {
+	cb := NewCommandBus()
+	answers := cb.SubscribeWith(context.Background(), "a", Policy{Delivery: BlockDelivery})
+	responses := cb.SubscribeWith(context.Background(), "userres", Policy{Delivery: BlockDelivery})
+
+	for i := 0; i < 100; i++ {
+		cb.Publish("/a answer", "user-id")
+		cb.Publish("/userres response", "user-id")
+
+		var got []CommandType
+		for len(got) < 2 {
+			select {
+			case c := <- answers:
+				got = append(got, c.Type)
+			case c := <- responses:
+				got = append(got, c.Type)
+			}
+		}
+		assert.Equal(t, []CommandType{"a", "userres"}, got)
+	}
+}
+
+func TestMatchTypes(t *testing.T) {
+	assert.True(t, CommandType("a").Match("a"))
+	assert.False(t, CommandType("a").Match("ab"))
+	assert.False(t, CommandType("").Match("a"))
+
+	assert.True(t, AllTypes.Match("a"))
+	assert.True(t, AllTypes.Match(""))
+
+	assert.True(t, CommandType("admin.*").Match("admin.msg"))
+	assert.True(t, CommandType("admin.*").Match("admin.clues.all"))
+	assert.False(t, CommandType("admin.*").Match("admin"))
+	assert.False(t, CommandType("admin.*").Match("adminmsg"))
+
+	types := Types{"", "a", "admin.*"}
+	assert.True(t, types.Match(""))
+	assert.True(t, types.Match("a"))
+	assert.True(t, types.Match("admin.msg"))
+	assert.False(t, types.Match("userres"))
+	assert.False(t, Types{}.Match("a"))
+}
+
+func TestSubscribeMatching(t *testing.T) {
+	cb := NewCommandBus()
+	policy := Policy{Delivery: UnboundedDelivery}
+
+	all := cb.SubscribeMatching(context.Background(), AllTypes, policy, nil)
+	some := cb.SubscribeMatching(context.Background(), Types{"", "a"}, policy, nil)
+	admin := cb.FilterSubscribeWith(context.Background(), "admin.*", policy, nil)
+	onlyUser := cb.SubscribeMatching(context.Background(), AllTypes, policy, func(cmd *Command) bool {
+		return cmd.UserID == "user-2"
+	})
+
+	cb.Publish("message", "user-1")
+	cb.Publish("/a answer", "user-1")
+	cb.Publish("/admin.msg hello", "user-1")
+	cb.Publish("/userres response", "user-2")
+
+	read := func(sub Subscription, count int) []CommandType {
+		var types []CommandType
+		for i := 0; i < count; i++ {
+			select {
+			case cmd := <- sub:
+				types = append(types, cmd.Type)
+			case <- time.After(50 * time.Millisecond):
+				return types
+			}
+		}
+
+		select {
+		case cmd := <- sub:
+			assert.Fail(t, "unexpected command", cmd.Type)
+		case <- time.After(10 * time.Millisecond):
+		}
+
+		return types
+	}
+
+	// the commands of different users may come in any order
+	assert.ElementsMatch(t, []CommandType{"", "a", "admin.msg", "userres"}, read(all, 4))
+	assert.Equal(t, []CommandType{"", "a"}, read(some, 2))
+	assert.Equal(t, []CommandType{"admin.msg"}, read(admin, 1))
+	assert.Equal(t, []CommandType{"userres"}, read(onlyUser, 1))
+}
+
+func TestCountMatchingSubscriptions(t *testing.T) {
+	cb := NewCommandBus()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	cb.Subscribe("a")
+	cb.SubscribeMatching(ctx, AllTypes, DefaultPolicy, nil)
+	cb.SubscribeMatching(ctx, Types{"a", "b"}, DefaultPolicy, nil)
+	cb.SubscribeWith(ctx, "admin.*", DefaultPolicy)
+
+	assert.Equal(t, 3, cb.SubscriptionsCount("a"))
+	assert.Equal(t, 2, cb.SubscriptionsCount("b"))
+	assert.Equal(t, 2, cb.SubscriptionsCount("admin.msg"))
+
+	cancel()
+
+	assert.Eventually(t, func() bool {
+		return cb.SubscriptionsCount("a") == 1 && cb.SubscriptionsCount("admin.msg") == 0
+	}, 50 * time.Millisecond, time.Millisecond, "must remove the cancelled subscriptions")
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	cb := NewCommandBus()
+	sub := cb.Subscribe("test")
+
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(cmd *Command) {
+				calls = append(calls, name)
+				next(cmd)
+			}
+		}
+	}
+	cb.Use(trace("first"), trace("second"))
+	cb.Use(trace("third"))
+
+	cb.Publish("/test command", "user-id")
+
+	assert.Equal(t, "command", (<- sub).Input)
+	assert.Equal(t, []string{"first", "second", "third"}, calls)
+}
+
+func TestMiddlewareModifiesCommand(t *testing.T) {
+	cb := NewCommandBus()
+	sub := cb.Subscribe("a")
+
+	cb.Use(func(next Handler) Handler {
+		return func(cmd *Command) {
+			cmd.ServiceData["checked"] = "true"
+			cmd.Input = strings.ToLower(cmd.Input)
+			next(cmd)
+		}
+	})
+
+	cb.Publish("/a ANSWER", "user-id", [2]string{"senderName", "Name"})
+
+	cmd := <- sub
+	assert.Equal(t, "answer", cmd.Input)
+	assert.Equal(t, map[string]string{"senderName": "Name", "checked": "true"}, cmd.ServiceData)
+}
+
+func TestMiddlewareRejectsCommand(t *testing.T) {
+	cb := NewCommandBus()
+	sub := cb.Subscribe("")
+
+	cb.Use(func(next Handler) Handler {
+		return func(cmd *Command) {
+			if cmd.UserID != "spammer" {
+				next(cmd)
+			}
+		}
+	})
+
+	cb.Publish("buy now", "spammer")
+	cb.Publish("hello", "user-id")
+
+	cmd := <- sub
+	assert.Equal(t, "hello", cmd.Input)
+	assert.Equal(t, "user-id", cmd.UserID)
+}
+
+func TestMiddlewareDuplicatesCommand(t *testing.T) {
+	cb := NewCommandBus()
+	answers := cb.SubscribeWith(context.Background(), "a", Policy{Delivery: UnboundedDelivery})
+	audit := cb.SubscribeWith(context.Background(), "audit", Policy{Delivery: UnboundedDelivery})
+
+	cb.Use(func(next Handler) Handler {
+		return func(cmd *Command) {
+			next(cmd)
+
+			cp := cmd.Copy()
+			cp.Type = "audit"
+			cp.ServiceData["original"] = string(cmd.Type)
+			next(cp)
+		}
+	})
+
+	cb.Publish("/a answer", "user-id")
+
+	original := <- answers
+	duplicate := <- audit
+	assert.Equal(t, CommandType("a"), original.Type)
+	assert.Equal(t, map[string]string{}, original.ServiceData)
+	assert.Equal(t, CommandType("audit"), duplicate.Type)
+	assert.Equal(t, "answer", duplicate.Input)
+	assert.Equal(t, []string{"answer"}, duplicate.Args)
+	assert.Equal(t, map[string]string{"original": "a"}, duplicate.ServiceData)
+}
+
+func TestCopyCommand(t *testing.T) {
+	cmd := &Command{
+		Type: "a",
+		Input: "answer",
+		Args: []string{"answer"},
+		UserID: "user-id",
+		ServiceData: map[string]string{"live": "true"},
+		Location: &Location{Latitude: 1, Longitude: 2},
+	}
+
+	cp := cmd.Copy()
+	assert.Equal(t, cmd, cp)
+
+	cp.Args[0] = "changed"
+	cp.ServiceData["live"] = ""
+	cp.Location.Latitude = 3
+
+	assert.Equal(t, "answer", cmd.Args[0])
+	assert.Equal(t, "true", cmd.ServiceData["live"])
+	assert.Equal(t, 1.0, cmd.Location.Latitude)
+}
+
+// waitGoroutines waits until no more than n goroutines are running.
+// assert.Eventually is not used since it runs the condition in a goroutine of its own
+func waitGoroutines(n int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	return true
+}
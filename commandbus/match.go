@@ -0,0 +1,47 @@
+package commandbus
+
+import "strings"
+
+// AllTypes subscribes to the commands of every type, plain messages included
+const AllTypes CommandType = "*"
+
+// Matcher selects the types of commands a subscription gets
+type Matcher interface {
+	Match(t CommandType) bool
+}
+
+// Match is true for the same type. AllTypes matches every type,
+// and a namespace like "admin.*" matches the types starting with "admin."
+func (ct CommandType) Match(t CommandType) bool {
+	if ct == AllTypes {
+		return true
+	}
+
+	if ct.namespace() {
+		return strings.HasPrefix(string(t), string(ct[:len(ct) - 1]))
+	}
+
+	return ct == t
+}
+
+// exact is true if the type matches only itself
+func (ct CommandType) exact() bool {
+	return ct != AllTypes && !ct.namespace()
+}
+
+func (ct CommandType) namespace() bool {
+	return strings.HasSuffix(string(ct), ".*")
+}
+
+// Types matches the commands of any of the types, which may be namespaces too
+type Types []CommandType
+
+func (ts Types) Match(t CommandType) bool {
+	for _, ct := range ts {
+		if ct.Match(t) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,33 @@
+package commandbus
+
+// Handler takes the published command further
+type Handler func(cmd *Command)
+
+// Middleware wraps the handler of the published commands. It may inspect or modify
+// the command before calling next, reject it by not calling next at all, or call
+// next more than once to duplicate it. Duplicates should be made with Copy,
+// since the subscribers get the command itself
+type Middleware func(next Handler) Handler
+
+// Use adds the middlewares to the bus. The commands pass the middlewares in
+// the order they are added, the first one added sees the command first.
+// The middlewares run in the goroutine of the publisher
+func (cb *CommandBus) Use(middlewares ...Middleware) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.middlewares = append(cb.middlewares, middlewares...)
+
+	h := Handler(cb.subs.Send)
+	for i := len(cb.middlewares) - 1; i >= 0; i-- {
+		h = cb.middlewares[i](h)
+	}
+	cb.publish = h
+}
+
+func (cb *CommandBus) handler() Handler {
+	cb.mu.RLock()
+	defer cb.mu.RUnlock()
+
+	return cb.publish
+}
@@ -0,0 +1,77 @@
+package commandbus
+
+import (
+	"time"
+)
+
+// Delivery is how commands reach a subscriber which does not read them right away
+type Delivery int
+
+const (
+	// BlockDelivery waits for the subscriber to read the command. If it does not
+	// within the timeout of the policy, the subscription is evicted. The next commands
+	// of the same user wait as well, so the subscriber sees the commands of a user
+	// in order even across several subscriptions
+	BlockDelivery Delivery = iota
+	// DropOldestDelivery keeps the commands in a buffer of the subscription,
+	// the oldest one is dropped to make room for a new one. Only the order
+	// within the subscription is kept, as with UnboundedDelivery
+	DropOldestDelivery
+	// UnboundedDelivery keeps all the commands until the subscriber reads them
+	UnboundedDelivery
+)
+
+// DropReason tells why the command did not reach the subscriber
+type DropReason int
+
+const (
+	// OldestDropped is the command dropped from the full buffer
+	OldestDropped DropReason = iota
+	// SubscriberEvicted is the command the subscriber did not read in time and the commands
+	// left in its queue, the subscription is removed and its channel is closed
+	SubscriberEvicted
+	// NewestDropped is the incoming command dropped since there is no buffer
+	// for it, the subscriber still reads the command before it
+	NewestDropped
+)
+
+func (r DropReason) String() string {
+	switch r {
+	case SubscriberEvicted:
+		return "subscriber evicted"
+	case NewestDropped:
+		return "newest dropped"
+	}
+
+	return "oldest dropped"
+}
+
+type Policy struct {
+	Delivery Delivery
+	// Timeout of BlockDelivery, zero waits until the subscription is cancelled
+	Timeout time.Duration
+	// Buffer of DropOldestDelivery is the number of commands which wait
+	// for the subscriber besides the one being delivered. With no buffer
+	// the subscriber gets the commands which come while it waits for them
+	Buffer int
+	// OnDrop is called with every command which did not reach the subscriber.
+	// It is called while the commands are dispatched, so it must be fast
+	OnDrop func(cmd *Command, reason DropReason)
+}
+
+// DefaultPolicy gives a subscriber 20ms to read the command,
+// after that the subscriber is considered dangling
+var DefaultPolicy = Policy{
+	Delivery: BlockDelivery,
+	Timeout: 20 * time.Millisecond,
+}
+
+func (p Policy) queued() bool {
+	return p.Delivery == DropOldestDelivery || p.Delivery == UnboundedDelivery
+}
+
+func (p Policy) drop(cmd *Command, reason DropReason) {
+	if p.OnDrop != nil {
+		p.OnDrop(cmd, reason)
+	}
+}
@@ -1,111 +1,347 @@
 package commandbus
 
-import "time"
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// dispatchShards is the number of queues the commands are dispatched from.
+// The commands of a user always go through the same queue, so they reach
+// the subscribers in order, while the queues are dispatched in parallel
+const dispatchShards = 64
 
 func NewSubscriptionsMap() *SubscriptionsMap {
-	m := &SubscriptionsMap{
-		subs: make(map[CommandType][]Subscription),
+	return &SubscriptionsMap{
+		subs: make(map[CommandType][]*subscription),
 	}
+}
 
-	m.startSubscriptionHandler()
+// SubscriptionsMap dispatches the commands to the subscriptions. A command is delivered
+// to all its subscribers at once, and the next command of the same user waits until
+// the blocking subscribers read it. Queued subscriptions are delivered by goroutines
+// of their own, so they never hold up the dispatch
+type SubscriptionsMap struct {
+	mu sync.RWMutex
+	subs map[CommandType][]*subscription
+	// patterns are the subscriptions to more than one type, they are matched against every command
+	patterns []*subscription
+	shards [dispatchShards]shard
+}
 
-	return m
+// shard is a queue of commands. A goroutine dispatches the queue while it is not empty
+type shard struct {
+	mu sync.Mutex
+	queue []*Command
+	busy bool
 }
 
-type SubscriptionsMap struct {
-	subs map[CommandType][]Subscription
-	createSub chan newSubscription
-	sendCmd chan *Command
-	deleteSub chan danglingSubscription
-	countSub chan countSubscriptions
+type subscription struct {
+	match Matcher
+	// exact is set if the subscription is to a single type, it is found by the type
+	exact bool
+	ch Subscription
+	policy Policy
+	// filter drops the commands the subscriber is not interested in, nil passes all
+	filter func(*Command) bool
+	// done is the context of the subscription, nil if it never ends
+	done <-chan struct{}
+
+	// send guards the channel of a blocking subscription,
+	// which the shards of different users write to.
+	// Once closed is set nothing is sent any more
+	send sync.Mutex
+	closed bool
+	// ended removes a blocking subscription and closes its channel once
+	ended sync.Once
+
+	// queue of a queued subscription, it is delivered by the pump
+	mu sync.Mutex
+	queue []*Command
+	queued chan struct{}
+	// idle is set while the pump waits for a command
+	idle bool
 }
 
-func (m *SubscriptionsMap) Create(cmdType CommandType) Subscription {
-	sub := make(Subscription)
-	m.createSub <- newSubscription{cmdType, sub}
+// Create adds the subscription to the types of commands the matcher selects. Once the context
+// is done, the subscription is removed and its channel is closed
+func (m *SubscriptionsMap) Create(ctx context.Context, match Matcher, policy Policy, filter func(*Command) bool) Subscription {
+	ct, ok := match.(CommandType)
+	sub := &subscription{
+		match: match,
+		exact: ok && ct.exact(),
+		ch: make(Subscription),
+		policy: policy,
+		filter: filter,
+		done: ctx.Done(),
+		queued: make(chan struct{}, 1),
+		idle: true,
+	}
 
-	return sub
+	m.mu.Lock()
+	if sub.exact {
+		m.subs[ct] = append(m.subs[ct], sub)
+	} else {
+		m.patterns = append(m.patterns, sub)
+	}
+	m.mu.Unlock()
+
+	if policy.queued() {
+		go m.pump(sub)
+	} else if sub.done != nil {
+		go func() {
+			<- sub.done
+			m.end(sub)
+		}()
+	}
+
+	return sub.ch
 }
 
+// Send puts the command into the queue of the shard of the user, it never waits for subscribers
 func (m *SubscriptionsMap) Send(cmd *Command) {
-	m.sendCmd <- cmd
+	sh := &m.shards[userShard(cmd.UserID)]
+
+	sh.mu.Lock()
+	sh.queue = append(sh.queue, cmd)
+	if sh.busy {
+		sh.mu.Unlock()
+		return
+	}
+	sh.busy = true
+	sh.mu.Unlock()
+
+	go m.dispatch(sh)
 }
+
+// Count is the number of subscriptions which get the commands of the type
 func (m *SubscriptionsMap) Count(cmdType CommandType) int {
-	req := countSubscriptions{
-		cmdType: cmdType,
-		count: make(chan int),
-	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-	m.countSub <- req
+	count := len(m.subs[cmdType])
+	for _, s := range m.patterns {
+		if s.match.Match(cmdType) {
+			count++
+		}
+	}
 
-	return <- req.count
+	return count
 }
 
-func (m *SubscriptionsMap) startSubscriptionHandler() {
-	m.createSub = make(chan newSubscription)
-	m.sendCmd = make(chan *Command)
-	m.deleteSub = make(chan danglingSubscription, 1)
-	m.countSub = make(chan countSubscriptions)
+func userShard(userID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
 
-	go func() {
-		for {
-			select {
-			case newSub := <- m.createSub:
-				m.create(newSub.cmdType, newSub.sub)
-			case cmd := <- m.sendCmd:
-				m.send(cmd)
-			case danglingSub := <- m.deleteSub:
-				m.delete(danglingSub.cmdType, danglingSub.sub)
-			case countReq := <- m.countSub:
-				countReq.count <- len(m.subs[countReq.cmdType])
-			}
-		}
-	}()
+	return int(h.Sum32() % dispatchShards)
 }
 
-func (m *SubscriptionsMap) create(cmdType CommandType, sub Subscription) {
-	m.subs[cmdType] = append(m.subs[cmdType], sub)
+func (m *SubscriptionsMap) dispatch(sh *shard) {
+	for {
+		sh.mu.Lock()
+		if len(sh.queue) == 0 {
+			sh.busy = false
+			sh.mu.Unlock()
+			return
+		}
+
+		cmd := sh.queue[0]
+		sh.queue[0] = nil
+		sh.queue = sh.queue[1:]
+		sh.mu.Unlock()
+
+		m.send(cmd)
+	}
 }
 
+// send delivers the command to the subscribers concurrently and waits for the blocking
+// ones. The subscriptions which are cancelled or evicted by their policy are removed
 func (m *SubscriptionsMap) send(cmd *Command) {
-	for _, s := range m.subs[cmd.Type] {
-		select {
-		case s <- cmd:
-		case <- time.After(20 * time.Millisecond):
-			m.deleteSub <- danglingSubscription{cmd.Type, s}
+	var blocking []*subscription
+	for _, s := range m.matching(cmd) {
+		if s.policy.queued() {
+			s.enqueue(cmd)
 			continue
 		}
+
+		blocking = append(blocking, s)
+	}
+
+	if len(blocking) == 1 {
+		m.deliver(blocking[0], cmd)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range blocking {
+		wg.Add(1)
+		go func(s *subscription) {
+			defer wg.Done()
+			m.deliver(s, cmd)
+		}(s)
+	}
+	wg.Wait()
+}
+
+func (m *SubscriptionsMap) matching(cmd *Command) []*subscription {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var subs []*subscription
+	for _, s := range m.subs[cmd.Type] {
+		if s.filter == nil || s.filter(cmd) {
+			subs = append(subs, s)
+		}
 	}
+
+	for _, s := range m.patterns {
+		if s.match.Match(cmd.Type) && (s.filter == nil || s.filter(cmd)) {
+			subs = append(subs, s)
+		}
+	}
+
+	return subs
 }
 
-func (m *SubscriptionsMap) delete(cmdType CommandType, sub Subscription) {
-	idx := -1
-	subs := m.subs[cmdType]
+func (m *SubscriptionsMap) deliver(s *subscription, cmd *Command) {
+	if !s.deliver(cmd) {
+		m.end(s)
+	}
+}
+
+// end removes the blocking subscription before its channel is closed,
+// so a subscriber which sees the channel closed never finds it counted
+func (m *SubscriptionsMap) end(s *subscription) {
+	s.ended.Do(func() {
+		m.delete(s)
+		s.close()
+	})
+}
+
+func (m *SubscriptionsMap) delete(sub *subscription) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !sub.exact {
+		m.patterns = without(m.patterns, sub)
+		return
+	}
+
+	cmdType := sub.match.(CommandType)
+	m.subs[cmdType] = without(m.subs[cmdType], sub)
+	if len(m.subs[cmdType]) == 0 {
+		delete(m.subs, cmdType)
+	}
+}
+
+func without(subs []*subscription, sub *subscription) []*subscription {
 	for i, s := range subs {
 		if s == sub {
-			idx = i
-			break
+			return append(subs[:i], subs[i + 1:]...)
 		}
 	}
 
-	if idx == -1 {
-		return
+	return subs
+}
+
+// deliver waits for the subscriber of a blocking subscription to read the command.
+// It is false if the subscription is cancelled or evicted by the policy, then it must be ended
+func (s *subscription) deliver(cmd *Command) bool {
+	s.send.Lock()
+	defer s.send.Unlock()
+
+	if s.closed {
+		return false
 	}
 
-	m.subs[cmdType] = append(subs[:idx], subs[idx + 1:]...)
+	var timeout <-chan time.Time
+	if s.policy.Timeout > 0 {
+		timer := time.NewTimer(s.policy.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case s.ch <- cmd:
+		return true
+	case <- s.done:
+	case <- timeout:
+		s.policy.drop(cmd, SubscriberEvicted)
+	}
+
+	s.closed = true
+
+	return false
 }
 
-type newSubscription struct {
-	cmdType CommandType
-	sub Subscription
+// close closes the channel of a blocking subscription, it waits for the command being sent
+func (s *subscription) close() {
+	s.send.Lock()
+	defer s.send.Unlock()
+
+	s.closed = true
+	close(s.ch)
 }
 
-type danglingSubscription struct {
-	cmdType CommandType
-	sub Subscription
+func (s *subscription) enqueue(cmd *Command) {
+	s.mu.Lock()
+	var dropped *Command
+	reason := OldestDropped
+	// an idle pump takes the command right away, so it does not need the buffer
+	full := s.policy.Delivery == DropOldestDelivery && len(s.queue) >= s.policy.Buffer && !s.idle
+	switch {
+	case !full:
+		s.queue = append(s.queue, cmd)
+		s.idle = false
+	case len(s.queue) == 0:
+		dropped = cmd
+		reason = NewestDropped
+	default:
+		dropped = s.queue[0]
+		s.queue = append(s.queue[1:], cmd)
+	}
+	s.mu.Unlock()
+
+	if dropped != nil {
+		s.policy.drop(dropped, reason)
+	}
+
+	select {
+	case s.queued <- struct{}{}:
+	default:
+	}
 }
 
-type countSubscriptions struct {
-	cmdType CommandType
-	count chan int
+// pump delivers the queue of a queued subscription until it is cancelled.
+// It is the only sender to the channel, so it closes the channel
+func (m *SubscriptionsMap) pump(s *subscription) {
+	defer close(s.ch)
+	defer m.delete(s)
+
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.idle = true
+			s.mu.Unlock()
+
+			select {
+			case <- s.queued:
+				continue
+			case <- s.done:
+				return
+			}
+		}
+
+		cmd := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		select {
+		case s.ch <- cmd:
+		case <- s.done:
+			return
+		}
+	}
 }
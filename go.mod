@@ -3,9 +3,10 @@ module github.com/merisho/quest
 go 1.14
 
 require (
-	github.com/go-telegram-bot-api/telegram-bot-api v4.6.4+incompatible // indirect
+	github.com/go-telegram-bot-api/telegram-bot-api v4.6.4+incompatible
 	github.com/looplab/fsm v0.1.0 // indirect
 	github.com/merisho/quester v0.0.0-20181007102557-ac1bfcc75734
 	github.com/stretchr/testify v1.6.1
 	github.com/technoweenie/multipartstreamer v1.0.1 // indirect
+	golang.org/x/text v0.3.3
 )
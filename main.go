@@ -2,132 +2,140 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
+	"flag"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/merisho/quest/admin"
+	"github.com/merisho/quest/bot"
 	"github.com/merisho/quest/commandbus"
+	"github.com/merisho/quest/outbox"
 	"github.com/merisho/quest/player"
 	"github.com/merisho/quest/quest"
+	"github.com/merisho/quest/session"
+	"github.com/merisho/quest/storage"
+	"github.com/merisho/quest/transport"
 	"io/ioutil"
 	"log"
 	"os"
-	"strconv"
-	"time"
 )
 
-func NewTGBotOut(id int64, bot *tgbotapi.BotAPI, cb *commandbus.CommandBus) *TGBotOut {
-	return &TGBotOut{
-		id: id,
-		bot: bot,
-		cb: cb,
+func main() {
+	console := flag.Bool("console", false, "play the quest in the terminal instead of Telegram")
+	var webhook transport.WebhookConfig
+	flag.StringVar(&webhook.URL, "webhook-url", "", "receive Telegram updates at this public URL instead of long polling")
+	flag.StringVar(&webhook.Listen, "listen", ":8080", "local address of the webhook server")
+	flag.StringVar(&webhook.SecretToken, "webhook-secret", "", "secret token Telegram must send with every update, required with -webhook-url")
+	flag.StringVar(&webhook.CertFile, "tls-cert", "", "TLS certificate file of the webhook server")
+	flag.StringVar(&webhook.KeyFile, "tls-key", "", "TLS key file of the webhook server")
+	flag.BoolVar(&webhook.SelfSigned, "tls-self-signed", false, "upload the self-signed TLS certificate to Telegram")
+	flag.Parse()
+
+	parsedConf := parsePlayerConfig("./config.json")
+	questOpts, err := quest.LoadOptions("./quest.json")
+	if err != nil {
+		panic(err)
 	}
-}
 
-type TGBotOut struct {
-	id int64
-	bot *tgbotapi.BotAPI
-	cb *commandbus.CommandBus
-}
+	commands := commandbus.NewCommandBus()
+	t, err := newTransport(*console, webhook, questOpts.SplitLongMessages, commands)
+	if err != nil {
+		panic(err)
+	}
 
-func (t *TGBotOut) Write(b []byte) (int, error) {
-	msg := tgbotapi.NewMessage(t.id, string(b))
-	_, err := t.bot.Send(msg)
+	progress, err := storage.NewFileStorage(parsedConf.StorageFile)
 	if err != nil {
-		return 0, err
+		panic(err)
 	}
 
-	botName := fmt.Sprintf("%s %s", t.bot.Self.FirstName, t.bot.Self.LastName)
-	t.cb.Publish("/userres " + string(b), strconv.FormatInt(t.id, 10), [2]string{"senderName", botName})
+	sessions := session.NewManager(func(userID string, out transport.Output, snap *storage.Snapshot) (*player.Player, error) {
+		return initPlayer(userID, commands, out, progress, snap)
+	})
+	b := bot.NewBot(t, commands, sessions)
+
+	err = sessions.Restore(progress, b.Out)
+	if err != nil {
+		log.Println("could not restore players:", err)
+	}
 
-	return len(b), nil
+	b.Run()
 }
 
-func main() {
-	if len(os.Args) < 2 {
-		panic("please supply Telegram bot token as the first argument")
+func newTransport(console bool, webhook transport.WebhookConfig, split outbox.SplitMode, cb *commandbus.CommandBus) (transport.Transport, error) {
+	if console {
+		return transport.NewConsole(os.Stdin, os.Stdout), nil
 	}
-	tgBotToken := os.Args[1]
-	bot, err := tgbotapi.NewBotAPI(tgBotToken)
-	if err != nil {
-		panic(err) // You should add better error handling than this!
+
+	if flag.NArg() < 1 {
+		return nil, errors.New("please supply Telegram bot token as the first argument")
 	}
 
-	log.Printf("Authorized on account %s", bot.Self.UserName)
+	tgBot, err := tgbotapi.NewBotAPI(flag.Arg(0))
+	if err != nil {
+		return nil, err
+	}
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
+	log.Printf("Authorized on account %s", tgBot.Self.UserName)
 
-	updates, err := bot.GetUpdatesChan(u)
+	var t transport.Transport
+	if webhook.URL != "" {
+		t, err = transport.NewTelegramWebhook(tgBot, webhook)
+	} else {
+		t, err = transport.NewTelegram(tgBot, 60)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	var p *player.Player
-	var a *admin.Admin
-	commands := commandbus.NewCommandBus()
-	for update := range updates {
-		msg := update.Message
-		if msg == nil {
-			continue
-		}
-
-		id := msg.Chat.ID
-
-		if msg.IsCommand() {
-			if msg.Command() == "philadelphia" {
-				if p != nil {
-					p.Destroy()
-				}
-
-				out := NewTGBotOut(id, bot, commands)
-				p = initPlayer(id, commands, out)
-				continue
-			}
-
-			if msg.Command() == "adminsecret" {
-				if a != nil {
-					a.Destroy()
-				}
-
-				out := NewTGBotOut(id, bot, commands)
-				a = admin.NewAdmin(strconv.FormatInt(id, 10), commands, out)
-				a.Greeting()
-				continue
-			}
-		}
-
-		fullName := fmt.Sprintf("%s %s", update.Message.From.FirstName, update.Message.From.LastName)
-		commands.Publish(update.Message.Text, strconv.FormatInt(id, 10), [2]string{"senderName", fullName})
+	conf := outbox.DefaultConfig
+	if split != "" {
+		conf.Split = split
+	}
+	conf.OnFailure = func(chatID, text string, err error) {
+		log.Printf("could not deliver message to %s: %s", chatID, err)
+		admin.ReportFailedSend(cb, chatID, text, err)
 	}
+
+	return outbox.New(t, conf), nil
 }
 
 type PlayerConfig struct {
 	IntroMessage string `json:"introMessage"`
+	CloseAnswerMessage string `json:"closeAnswerMessage"`
 	OutroMessage string `json:"outroMessage"`
-	OutroMessageDelay time.Duration `json:"outroMessageDelay"`
+	OutroMessageDelay quest.Duration `json:"outroMessageDelay"`
 	WrongAnswersForClue int `json:"wrongAnswersForClue"`
+	StorageFile string `json:"storageFile"`
 }
 
-func initPlayer(id int64, cb *commandbus.CommandBus, out *TGBotOut) *player.Player {
+func initPlayer(userID string, cb *commandbus.CommandBus, out transport.Output, st storage.Storage, snap *storage.Snapshot) (*player.Player, error) {
 	parsedConf := parsePlayerConfig("./config.json")
 
-	userID := strconv.FormatInt(id, 10)
 	conf := player.Config{
 		UserID: userID,
 		WrongAnswersForClue: parsedConf.WrongAnswersForClue,
 		IntroMessage: parsedConf.IntroMessage,
+		CloseAnswerMessage: parsedConf.CloseAnswerMessage,
 		OutroMessage: parsedConf.OutroMessage,
-		OutroMessageDelay: parsedConf.OutroMessageDelay,
+		OutroMessageDelay: parsedConf.OutroMessageDelay.Duration(),
+		Storage: st,
 	}
 
 	q, err := quest.NewQuestFromFile("./quest.json", out)
 	if err != nil {
-		log.Println(err)
-		return nil
+		return nil, err
 	}
 
-	return player.NewPlayer(conf, cb, q, out)
+	if snap != nil {
+		return player.RestorePlayer(conf, cb, q, out, *snap)
+	}
+
+	return player.NewPlayer(conf, cb, q, out), nil
 }
 
 func parsePlayerConfig(path string) PlayerConfig {
-	var msgs PlayerConfig
+	msgs := PlayerConfig{
+		StorageFile: "./progress.json",
+	}
 
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -0,0 +1,296 @@
+package outbox
+
+import (
+	"errors"
+	"github.com/merisho/quest/scheduler"
+	"github.com/merisho/quest/transport"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var ClosedErr = errors.New("outbox is closed")
+
+type Config struct {
+	// GlobalInterval is the least time between any two sends
+	GlobalInterval time.Duration
+	// ChatInterval is the least time between two sends to the same chat
+	ChatInterval time.Duration
+	// MaxRetries is how many times a failed message is sent again before giving up
+	MaxRetries int
+	// Backoff is the delay before the first retry, it doubles with every next one
+	Backoff time.Duration
+	MaxBackoff time.Duration
+	// MaxLength is the longest message the transport accepts, longer ones
+	// are split into several messages. Zero means no limit
+	MaxLength int
+	Split SplitMode
+	// OnFailure is called with the messages which could not be delivered
+	OnFailure func(chatID, text string, err error)
+	// Clock spaces the sends and delays the retries, it is the real clock if nil
+	Clock scheduler.Clock
+}
+
+// DefaultConfig keeps within the limits of the Telegram Bot API:
+// about 30 messages per second overall and one per second in a chat
+var DefaultConfig = Config{
+	GlobalInterval: time.Second / 30,
+	ChatInterval: time.Second,
+	MaxRetries: 5,
+	Backoff: time.Second,
+	MaxBackoff: time.Minute,
+	MaxLength: MaxMessageLength,
+	Split: SplitParagraphs,
+}
+
+// New wraps the transport so that sending to a chat only puts the message
+// in the queue of the chat. The queues are sent in the background within
+// the rate limits, the messages of a chat are delivered in order
+func New(t transport.Transport, conf Config) *Outbox {
+	if conf.Clock == nil {
+		conf.Clock = scheduler.RealClock
+	}
+
+	return &Outbox{
+		t: t,
+		conf: conf,
+		global: &limiter{interval: conf.GlobalInterval, clock: conf.Clock},
+		chats: make(map[string]*chat),
+	}
+}
+
+type Outbox struct {
+	t transport.Transport
+	conf Config
+	global *limiter
+	mu sync.Mutex
+	chats map[string]*chat
+	closed bool
+	wg sync.WaitGroup
+}
+
+type chat struct {
+	id string
+	out transport.Output
+	limiter *limiter
+	queue []transport.Outgoing
+	sending bool
+}
+
+func (o *Outbox) Messages() <-chan transport.Message {
+	return o.t.Messages()
+}
+
+func (o *Outbox) SelfName() string {
+	return o.t.SelfName()
+}
+
+// Acknowledge is not queued, the player waits for it right after pressing the button
+func (o *Outbox) Acknowledge(press transport.Message, text string) error {
+	a, ok := o.t.(transport.Acknowledger)
+	if !ok {
+		return nil
+	}
+
+	return a.Acknowledge(press, text)
+}
+
+func (o *Outbox) Output(chatID string) transport.Output {
+	return &output{
+		o: o,
+		chatID: chatID,
+	}
+}
+
+// Close stops accepting messages and waits until the queued ones are sent
+func (o *Outbox) Close() {
+	o.mu.Lock()
+	o.closed = true
+	o.mu.Unlock()
+
+	o.wg.Wait()
+}
+
+func (o *Outbox) enqueue(chatID string, msg transport.Outgoing) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return ClosedErr
+	}
+
+	c, ok := o.chats[chatID]
+	if !ok {
+		c = &chat{
+			id: chatID,
+			out: o.t.Output(chatID),
+			limiter: &limiter{interval: o.conf.ChatInterval, clock: o.conf.Clock},
+		}
+		o.chats[chatID] = c
+	}
+
+	c.queue = append(c.queue, o.split(msg)...)
+
+	if !c.sending {
+		c.sending = true
+		o.wg.Add(1)
+		go o.drain(c)
+	}
+
+	return nil
+}
+
+// split makes the messages of the text which fit the limits. A caption is limited
+// even more than a text, what does not fit goes in text messages after the media.
+// The first part replies, the keyboard goes under the last one
+func (o *Outbox) split(msg transport.Outgoing) []transport.Outgoing {
+	if o.conf.MaxLength <= 0 {
+		return []transport.Outgoing{msg}
+	}
+
+	var texts []string
+	text := msg.Text
+	if msg.Media != nil {
+		limit := MaxCaptionLength
+		if o.conf.MaxLength < limit {
+			limit = o.conf.MaxLength
+		}
+
+		caption := Split(text, limit, o.conf.Split, msg.ParseMode)[0]
+		texts = append(texts, caption)
+		text = strings.TrimLeftFunc(text[len(caption):], unicode.IsSpace)
+	}
+
+	if text != "" || len(texts) == 0 {
+		texts = append(texts, Split(text, o.conf.MaxLength, o.conf.Split, msg.ParseMode)...)
+	}
+
+	msgs := make([]transport.Outgoing, len(texts))
+	for i, t := range texts {
+		part := msg
+		part.Text = t
+		if i > 0 {
+			part.Media = nil
+			part.ReplyTo = 0
+		}
+		if i < len(texts) - 1 {
+			part.Keyboard = nil
+		}
+
+		msgs[i] = part
+	}
+
+	return msgs
+}
+
+// drain sends the queue of the chat until it is empty
+func (o *Outbox) drain(c *chat) {
+	defer o.wg.Done()
+
+	for {
+		o.mu.Lock()
+		if len(c.queue) == 0 {
+			c.sending = false
+			o.mu.Unlock()
+			return
+		}
+
+		msg := c.queue[0]
+		c.queue = c.queue[1:]
+		o.mu.Unlock()
+
+		o.deliver(c, msg)
+	}
+}
+
+func (o *Outbox) deliver(c *chat, msg transport.Outgoing) {
+	for attempt := 1; ; attempt++ {
+		c.limiter.wait()
+		o.global.wait()
+
+		err := c.out.Send(msg)
+		if err == nil {
+			return
+		}
+
+		var sendErr *transport.SendError
+		if errors.As(err, &sendErr) && sendErr.Permanent || attempt > o.conf.MaxRetries {
+			o.fail(c.id, msg.String(), err)
+			return
+		}
+
+		delay := o.backoff(attempt)
+		if sendErr != nil && sendErr.RetryAfter > 0 {
+			delay = sendErr.RetryAfter
+		}
+
+		sleep(o.conf.Clock, delay)
+	}
+}
+
+func (o *Outbox) backoff(attempt int) time.Duration {
+	d := o.conf.Backoff
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if o.conf.MaxBackoff > 0 && d >= o.conf.MaxBackoff {
+			return o.conf.MaxBackoff
+		}
+	}
+
+	return d
+}
+
+func (o *Outbox) fail(chatID, text string, err error) {
+	if o.conf.OnFailure != nil {
+		o.conf.OnFailure(chatID, text, err)
+	}
+}
+
+type output struct {
+	o *Outbox
+	chatID string
+}
+
+func (out *output) Send(msg transport.Outgoing) error {
+	return out.o.enqueue(out.chatID, msg)
+}
+
+// limiter spaces the sends at least the interval apart.
+// Every wait reserves the next free slot
+type limiter struct {
+	mu sync.Mutex
+	interval time.Duration
+	clock scheduler.Clock
+	next time.Time
+}
+
+func (l *limiter) wait() {
+	if l.interval <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := l.clock.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	l.mu.Unlock()
+
+	sleep(l.clock, at.Sub(now))
+}
+
+// sleep waits for the timer of the clock, so a fake clock moves the sends in tests
+func sleep(clock scheduler.Clock, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	done := make(chan struct{})
+	clock.AfterFunc(d, func() {
+		close(done)
+	})
+	<- done
+}
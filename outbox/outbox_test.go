@@ -0,0 +1,327 @@
+package outbox
+
+import (
+	"errors"
+	"fmt"
+	"github.com/merisho/quest/scheduler"
+	"github.com/merisho/quest/transport"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTransport records the sent messages and fails the sends with
+// the errors queued for the chat
+type fakeTransport struct {
+	mu sync.Mutex
+	sent map[string][]string
+	sentAt []time.Time
+	outgoing []transport.Outgoing
+	errs map[string][]error
+	attempts int
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{
+		sent: make(map[string][]string),
+		errs: make(map[string][]error),
+	}
+}
+
+func (t *fakeTransport) Messages() <-chan transport.Message {
+	return nil
+}
+
+func (t *fakeTransport) SelfName() string {
+	return "Quest Bot"
+}
+
+func (t *fakeTransport) Output(chatID string) transport.Output {
+	return &fakeOutput{
+		t: t,
+		chatID: chatID,
+	}
+}
+
+func (t *fakeTransport) fail(chatID string, errs ...error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.errs[chatID] = append(t.errs[chatID], errs...)
+}
+
+func (t *fakeTransport) messages(chatID string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]string(nil), t.sent[chatID]...)
+}
+
+func (t *fakeTransport) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.sentAt)
+}
+
+type fakeOutput struct {
+	t *fakeTransport
+	chatID string
+}
+
+func (w *fakeOutput) Send(msg transport.Outgoing) error {
+	w.t.mu.Lock()
+	defer w.t.mu.Unlock()
+
+	w.t.attempts++
+	if errs := w.t.errs[w.chatID]; len(errs) > 0 {
+		w.t.errs[w.chatID] = errs[1:]
+		return errs[0]
+	}
+
+	w.t.sent[w.chatID] = append(w.t.sent[w.chatID], msg.Text)
+	w.t.sentAt = append(w.t.sentAt, time.Now())
+	w.t.outgoing = append(w.t.outgoing, msg)
+
+	return nil
+}
+
+type failure struct {
+	chatID string
+	text string
+	err error
+}
+
+func testConfig(failures *[]failure) Config {
+	var mu sync.Mutex
+	if failures == nil {
+		failures = new([]failure)
+	}
+
+	return Config{
+		MaxRetries: 3,
+		Backoff: time.Millisecond,
+		MaxBackoff: 5 * time.Millisecond,
+		OnFailure: func(chatID, text string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			*failures = append(*failures, failure{chatID, text, err})
+		},
+	}
+}
+
+func TestKeepsOrderOfChats(t *testing.T) {
+	ft := newFakeTransport()
+	o := New(ft, testConfig(nil))
+
+	var want1, want2 []string
+	for i := 0; i < 20; i++ {
+		msg := fmt.Sprintf("message %d", i)
+		want1 = append(want1, msg)
+		want2 = append(want2, msg)
+
+		err := o.Output("1").Send(transport.Outgoing{Text: msg})
+		assert.NoError(t, err)
+		err = o.Output("2").Send(transport.Outgoing{Text: msg})
+		assert.NoError(t, err)
+	}
+
+	o.Close()
+
+	assert.Equal(t, want1, ft.messages("1"))
+	assert.Equal(t, want2, ft.messages("2"))
+}
+
+func TestRetriesTemporaryErrors(t *testing.T) {
+	var failures []failure
+	ft := newFakeTransport()
+	ft.fail("1", errors.New("connection reset"), errors.New("connection reset"))
+	o := New(ft, testConfig(&failures))
+
+	o.Output("1").Send(transport.Outgoing{Text: "Welcome"})
+	o.Output("1").Send(transport.Outgoing{Text: "Mission 1"})
+	o.Close()
+
+	assert.Equal(t, []string{"Welcome", "Mission 1"}, ft.messages("1"))
+	assert.Equal(t, 4, ft.attempts)
+	assert.Empty(t, failures)
+}
+
+func TestHonorsRetryAfter(t *testing.T) {
+	ft := newFakeTransport()
+	ft.fail("1", &transport.SendError{
+		Err: errors.New("Too Many Requests: retry after 1"),
+		RetryAfter: 50 * time.Millisecond,
+	})
+	o := New(ft, testConfig(nil))
+
+	start := time.Now()
+	o.Output("1").Send(transport.Outgoing{Text: "Welcome"})
+	o.Close()
+
+	assert.Equal(t, []string{"Welcome"}, ft.messages("1"))
+	assert.True(t, ft.sentAt[0].Sub(start) >= 50 * time.Millisecond)
+}
+
+func TestReportsPermanentFailures(t *testing.T) {
+	var failures []failure
+	ft := newFakeTransport()
+	blocked := &transport.SendError{
+		Err: errors.New("Forbidden: bot was blocked by the user"),
+		Permanent: true,
+	}
+	ft.fail("1", blocked)
+	o := New(ft, testConfig(&failures))
+
+	o.Output("1").Send(transport.Outgoing{Text: "Welcome"})
+	o.Output("1").Send(transport.Outgoing{Text: "Mission 1"})
+	o.Close()
+
+	assert.Equal(t, []string{"Mission 1"}, ft.messages("1"))
+	assert.Equal(t, 2, ft.attempts)
+	assert.Equal(t, []failure{{"1", "Welcome", blocked}}, failures)
+}
+
+func TestGivesUpAfterMaxRetries(t *testing.T) {
+	var failures []failure
+	ft := newFakeTransport()
+	reset := errors.New("connection reset")
+	ft.fail("1", reset, reset, reset, reset, reset)
+	o := New(ft, testConfig(&failures))
+
+	o.Output("1").Send(transport.Outgoing{Text: "Welcome"})
+	o.Output("1").Send(transport.Outgoing{Text: "Mission 1"})
+	o.Close()
+
+	assert.Equal(t, []string{"Mission 1"}, ft.messages("1"))
+	assert.Equal(t, []failure{{"1", "Welcome", reset}}, failures)
+}
+
+func TestLimitsRate(t *testing.T) {
+	ft := newFakeTransport()
+	clock := scheduler.NewFakeClock(time.Now())
+	conf := testConfig(nil)
+	conf.ChatInterval = 30 * time.Millisecond
+	conf.GlobalInterval = 10 * time.Millisecond
+	conf.Clock = clock
+	o := New(ft, conf)
+
+	for i := 0; i < 3; i++ {
+		o.Output("1").Send(transport.Outgoing{Text: "chat 1"})
+	}
+	assert.Eventually(t, func() bool {
+		return ft.count() == 1 && clock.Pending() == 1
+	}, time.Second, time.Millisecond)
+
+	clock.Advance(29 * time.Millisecond)
+	assert.Equal(t, 1, ft.count(), "the chat must wait for its interval")
+	clock.Advance(time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return ft.count() == 2 && clock.Pending() == 1
+	}, time.Second, time.Millisecond)
+	clock.Advance(30 * time.Millisecond)
+	o.Close()
+	assert.Equal(t, 3, ft.count())
+
+	// every chat reserves the next free slot of the global interval
+	ft = newFakeTransport()
+	o = New(ft, conf)
+	for i := 0; i < 5; i++ {
+		o.Output(fmt.Sprint(i)).Send(transport.Outgoing{Text: "hello"})
+	}
+	assert.Eventually(t, func() bool {
+		return ft.count() == 1 && clock.Pending() == 4
+	}, time.Second, time.Millisecond)
+
+	for sent := 2; sent <= 5; sent++ {
+		clock.Advance(9 * time.Millisecond)
+		assert.Equal(t, sent - 1, ft.count(), "the sends must wait for the global interval")
+		clock.Advance(time.Millisecond)
+		assert.Eventually(t, func() bool {
+			return ft.count() == sent
+		}, time.Second, time.Millisecond)
+	}
+	o.Close()
+}
+
+func TestSplitsLongMessages(t *testing.T) {
+	ft := newFakeTransport()
+	conf := testConfig(nil)
+	conf.MaxLength = 20
+	o := New(ft, conf)
+
+	o.Output("1").Send(transport.Outgoing{Text: "Welcome to Mission 1.\n\nFind the old bridge"})
+	o.Output("1").Send(transport.Outgoing{Text: "task 1"})
+	o.Close()
+
+	assert.Equal(t, []string{
+		"Welcome to Mission",
+		"1.",
+		"Find the old bridge",
+		"task 1",
+	}, ft.messages("1"))
+}
+
+func TestSplitsLongCaptions(t *testing.T) {
+	ft := newFakeTransport()
+	conf := testConfig(nil)
+	conf.MaxLength = MaxMessageLength
+	o := New(ft, conf)
+
+	caption := strings.Repeat("a", 1000) + ". " + strings.Repeat("b", 100)
+	photo := &transport.Media{Type: transport.Photo, File: "bridge.jpg"}
+	err := o.Output("1").Send(transport.Outgoing{
+		Text: caption,
+		ParseMode: transport.HTML,
+		Media: photo,
+	})
+	assert.NoError(t, err)
+	o.Close()
+
+	assert.Equal(t, []transport.Outgoing{
+		{Text: strings.Repeat("a", 1000) + ".", ParseMode: transport.HTML, Media: photo},
+		{Text: strings.Repeat("b", 100), ParseMode: transport.HTML},
+	}, ft.outgoing)
+}
+
+func TestSplitKeepsReplyAndKeyboard(t *testing.T) {
+	ft := newFakeTransport()
+	conf := testConfig(nil)
+	conf.MaxLength = 10
+	o := New(ft, conf)
+
+	keyboard := [][]transport.Button{{{Text: "yes", Data: "yes"}}}
+	o.Output("1").Send(transport.Outgoing{
+		Text: "Left or right? Choose",
+		Kind: transport.StatementMessage,
+		ReplyTo: 42,
+		Keyboard: keyboard,
+	})
+	o.Close()
+
+	assert.Equal(t, []transport.Outgoing{
+		{Text: "Left or", Kind: transport.StatementMessage, ReplyTo: 42},
+		{Text: "right?", Kind: transport.StatementMessage},
+		{Text: "Choose", Kind: transport.StatementMessage, Keyboard: keyboard},
+	}, ft.outgoing)
+}
+
+func TestSendAfterClose(t *testing.T) {
+	o := New(newFakeTransport(), testConfig(nil))
+	o.Close()
+
+	err := o.Output("1").Send(transport.Outgoing{Text: "Welcome"})
+	assert.Equal(t, ClosedErr, err)
+}
+
+func TestBackoff(t *testing.T) {
+	o := New(newFakeTransport(), Config{Backoff: time.Second, MaxBackoff: 5 * time.Second})
+
+	assert.Equal(t, time.Second, o.backoff(1))
+	assert.Equal(t, 2 * time.Second, o.backoff(2))
+	assert.Equal(t, 4 * time.Second, o.backoff(3))
+	assert.Equal(t, 5 * time.Second, o.backoff(4))
+}
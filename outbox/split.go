@@ -0,0 +1,224 @@
+package outbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/merisho/quest/transport"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// MaxMessageLength is the longest text Telegram accepts in a message
+	MaxMessageLength = 4096
+	// MaxCaptionLength is the longest caption of media
+	MaxCaptionLength = 1024
+)
+
+// SplitMode is the coarsest boundary long messages are split on.
+// When a part does not fit even so, finer boundaries are tried
+type SplitMode string
+
+const (
+	SplitParagraphs SplitMode = "paragraph"
+	SplitSentences SplitMode = "sentence"
+	SplitWords SplitMode = "word"
+)
+
+func (m *SplitMode) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	switch mode := SplitMode(s); mode {
+	case "", SplitParagraphs, SplitSentences, SplitWords:
+		*m = mode
+		return nil
+	}
+
+	return fmt.Errorf("unknown split mode %q", s)
+}
+
+func (m SplitMode) boundaries() []func(text string, p int) bool {
+	switch m {
+	case SplitWords:
+		return []func(string, int) bool{wordEnd}
+	case SplitSentences:
+		return []func(string, int) bool{sentenceEnd, wordEnd}
+	default:
+		return []func(string, int) bool{paragraphEnd, sentenceEnd, wordEnd}
+	}
+}
+
+// Split cuts the text into parts no longer than the limit. Every part ends
+// at the last boundary which fits. A formatting entity of the parse mode,
+// like *bold* or <b>bold</b>, is never cut unless it is longer than the limit
+// itself, and neither are escapes like \. or &amp;
+func Split(text string, limit int, mode SplitMode, parseMode transport.ParseMode) []string {
+	var parts []string
+	for textLength(text) > limit {
+		cut := cutPoint(text, limit, mode, parseMode)
+
+		if part := strings.TrimRightFunc(text[:cut], unicode.IsSpace); part != "" {
+			parts = append(parts, part)
+		}
+		text = strings.TrimLeftFunc(text[cut:], unicode.IsSpace)
+	}
+
+	if text != "" || len(parts) == 0 {
+		parts = append(parts, text)
+	}
+
+	return parts
+}
+
+// cutPoint is the byte offset the first part of the text ends at
+func cutPoint(text string, limit int, mode SplitMode, parseMode transport.ParseMode) int {
+	max := prefixBytes(text, limit)
+	spans := entitySpans(text, parseMode)
+
+	for _, isBoundary := range mode.boundaries() {
+		for p := max; p > 0; p-- {
+			if isBoundary(text, p) && !insideSpan(spans, p) {
+				return p
+			}
+		}
+	}
+
+	entityStart := max
+	for _, s := range spans {
+		if s[0] > 0 && s[0] < entityStart && max < s[1] {
+			entityStart = s[0]
+		}
+	}
+
+	return entityStart
+}
+
+func paragraphEnd(text string, p int) bool {
+	return strings.HasPrefix(text[p:], "\n\n")
+}
+
+func sentenceEnd(text string, p int) bool {
+	if strings.HasPrefix(text[p:], "\n") {
+		return true
+	}
+
+	if !wordEnd(text, p) {
+		return false
+	}
+
+	r, _ := utf8.DecodeLastRuneInString(text[:p])
+	return strings.ContainsRune(".!?…", r)
+}
+
+func wordEnd(text string, p int) bool {
+	return p < len(text) && (text[p] == ' ' || text[p] == '\n' || text[p] == '\t')
+}
+
+// textLength counts the text the way Telegram does, in UTF-16 code units
+func textLength(text string) int {
+	n := 0
+	for _, r := range text {
+		n++
+		if r > 0xFFFF {
+			n++
+		}
+	}
+
+	return n
+}
+
+// prefixBytes is the length in bytes of the longest prefix which fits the limit
+func prefixBytes(text string, limit int) int {
+	n := 0
+	for i, r := range text {
+		n++
+		if r > 0xFFFF {
+			n++
+		}
+
+		if n > limit {
+			if i == 0 {
+				// the limit is too short even for one character
+				return utf8.RuneLen(r)
+			}
+
+			return i
+		}
+	}
+
+	return len(text)
+}
+
+var (
+	markdownEntities = []*regexp.Regexp{
+		regexp.MustCompile("(?s)```.*?```"),
+		regexp.MustCompile("`[^`\n]*`"),
+		regexp.MustCompile(`\[[^\]\n]*\]\([^)\n]*\)`),
+		regexp.MustCompile(`\*[^*\n]+\*`),
+		regexp.MustCompile(`_[^_\n]+_`),
+	}
+	// MarkdownV2 adds spoilers, underlines and strikethroughs
+	markdownV2Entities = append([]*regexp.Regexp{
+		regexp.MustCompile(`\|\|[^\n]+?\|\|`),
+		regexp.MustCompile(`__[^_\n]+__`),
+		regexp.MustCompile(`~[^~\n]+~`),
+	}, markdownEntities...)
+	markdownEscape = regexp.MustCompile(`(?s)\\.`)
+	htmlOpeningTag = regexp.MustCompile(`<(b|strong|i|em|u|ins|s|strike|del|a|code|pre|tg-spoiler|blockquote)(\s[^>]*)?>`)
+	htmlTag = regexp.MustCompile(`</?[a-zA-Z][a-zA-Z-]*(\s[^>]*)?>`)
+	htmlCharRef = regexp.MustCompile(`&(#[0-9]+|#x[0-9a-fA-F]+|[a-zA-Z]+);`)
+)
+
+// entitySpans are the byte ranges of the text which must not be cut: the formatting
+// entities of the parse mode and its escapes. Plain text has none, its *stars* are just text
+func entitySpans(text string, mode transport.ParseMode) [][2]int {
+	switch mode {
+	case transport.Markdown:
+		return matchSpans(text, append([]*regexp.Regexp{markdownEscape}, markdownEntities...))
+	case transport.MarkdownV2:
+		return matchSpans(text, append([]*regexp.Regexp{markdownEscape}, markdownV2Entities...))
+	case transport.HTML:
+		return htmlSpans(text)
+	default:
+		return nil
+	}
+}
+
+func matchSpans(text string, res []*regexp.Regexp) [][2]int {
+	var spans [][2]int
+	for _, re := range res {
+		for _, m := range re.FindAllStringIndex(text, -1) {
+			spans = append(spans, [2]int{m[0], m[1]})
+		}
+	}
+
+	return spans
+}
+
+// htmlSpans are the elements with their contents, the tags and the character references
+func htmlSpans(text string) [][2]int {
+	spans := matchSpans(text, []*regexp.Regexp{htmlTag, htmlCharRef})
+	for _, m := range htmlOpeningTag.FindAllStringSubmatchIndex(text, -1) {
+		closing := "</" + text[m[2]:m[3]] + ">"
+		if i := strings.Index(text[m[1]:], closing); i >= 0 {
+			spans = append(spans, [2]int{m[0], m[1] + i + len(closing)})
+		}
+	}
+
+	return spans
+}
+
+func insideSpan(spans [][2]int, p int) bool {
+	for _, s := range spans {
+		if s[0] < p && p < s[1] {
+			return true
+		}
+	}
+
+	return false
+}
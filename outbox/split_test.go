@@ -0,0 +1,131 @@
+package outbox
+
+import (
+	"encoding/json"
+	"github.com/merisho/quest/transport"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestSplitShortText(t *testing.T) {
+	assert.Equal(t, []string{"Welcome to Mission 1"}, Split("Welcome to Mission 1", 100, SplitParagraphs, transport.PlainText))
+	assert.Equal(t, []string{""}, Split("", 100, SplitParagraphs, transport.PlainText))
+}
+
+func TestSplitParagraphs(t *testing.T) {
+	text := "First paragraph. Still first.\n\nSecond one.\n\nThird one."
+
+	assert.Equal(t, []string{
+		"First paragraph. Still first.",
+		"Second one.\n\nThird one.",
+	}, Split(text, 30, SplitParagraphs, transport.PlainText))
+}
+
+func TestSplitFallsBackToSentencesAndWords(t *testing.T) {
+	text := "First sentence. Second sentence is long.\n\nThe end"
+
+	assert.Equal(t, []string{
+		"First sentence.",
+		"Second sentence is long.",
+		"The end",
+	}, Split(text, 30, SplitParagraphs, transport.PlainText))
+
+	assert.Equal(t, []string{
+		"averyveryverylongword and",
+		"more",
+	}, Split("averyveryverylongword and more", 25, SplitParagraphs, transport.PlainText))
+}
+
+func TestSplitSentences(t *testing.T) {
+	text := "One. Two!\n\nThree? Four."
+
+	assert.Equal(t, []string{
+		"One. Two!\n\nThree?",
+		"Four.",
+	}, Split(text, 18, SplitSentences, transport.PlainText))
+}
+
+func TestSplitWords(t *testing.T) {
+	text := "One. Two three four"
+
+	assert.Equal(t, []string{
+		"One. Two three",
+		"four",
+	}, Split(text, 15, SplitWords, transport.PlainText))
+}
+
+func TestSplitWithoutBoundaries(t *testing.T) {
+	assert.Equal(t, []string{"abcd", "efgh", "ij"}, Split("abcdefghij", 4, SplitParagraphs, transport.PlainText))
+	assert.Equal(t, []string{"приве", "т"}, Split("привет", 5, SplitParagraphs, transport.PlainText))
+}
+
+func TestSplitCountsUTF16(t *testing.T) {
+	text := strings.Repeat("😀", 3)
+
+	assert.Equal(t, []string{"😀😀", "😀"}, Split(text, 5, SplitWords, transport.PlainText))
+	assert.Equal(t, []string{"😀", "😀", "😀"}, Split(text, 1, SplitWords, transport.PlainText))
+}
+
+func TestSplitKeepsEntities(t *testing.T) {
+	assert.Equal(t, []string{
+		"Go to",
+		"*the old bridge*",
+	}, Split("Go to *the old bridge*", 16, SplitWords, transport.Markdown))
+
+	assert.Equal(t, []string{
+		"Go to",
+		"<b>the old bridge</b> now",
+	}, Split("Go to <b>the old bridge</b> now", 26, SplitWords, transport.HTML))
+
+	assert.Equal(t, []string{
+		"Run",
+		"```\nfirst\n\nsecond\n```",
+	}, Split("Run ```\nfirst\n\nsecond\n```", 22, SplitParagraphs, transport.Markdown))
+
+	assert.Equal(t, []string{
+		"See",
+		"[the map](http://example.com/a b)",
+	}, Split("See [the map](http://example.com/a b)", 35, SplitWords, transport.Markdown))
+
+	assert.Equal(t, []string{
+		"It",
+		"||flows under||",
+	}, Split("It ||flows under||", 15, SplitWords, transport.MarkdownV2))
+}
+
+func TestSplitPlainTextHasNoEntities(t *testing.T) {
+	assert.Equal(t, []string{
+		"Go to *the old",
+		"bridge*",
+	}, Split("Go to *the old bridge*", 16, SplitWords, transport.PlainText))
+
+	assert.Equal(t, []string{
+		"Go to <b>the",
+		"old bridge</b>",
+	}, Split("Go to <b>the old bridge</b>", 14, SplitWords, transport.PlainText))
+}
+
+func TestSplitKeepsEscapes(t *testing.T) {
+	assert.Equal(t, []string{"abc", "\\.de", "f"}, Split("abc\\.def", 4, SplitWords, transport.MarkdownV2))
+	assert.Equal(t, []string{"a", "&amp;", "b"}, Split("a&amp;b", 5, SplitWords, transport.HTML))
+}
+
+func TestSplitCutsEntitiesLongerThanLimit(t *testing.T) {
+	assert.Equal(t, []string{
+		"Go",
+		"*to the",
+		"old*",
+	}, Split("Go *to the old*", 8, SplitWords, transport.Markdown))
+}
+
+func TestSplitModeJSON(t *testing.T) {
+	var conf struct {
+		Split SplitMode `json:"split"`
+	}
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"split": "sentence"}`), &conf))
+	assert.Equal(t, SplitSentences, conf.Split)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"split": "letter"}`), &conf))
+}
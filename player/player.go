@@ -1,10 +1,16 @@
 package player
 
 import (
+	"context"
+	"fmt"
 	"github.com/merisho/quest/commandbus"
 	"github.com/merisho/quest/quest"
-	"io"
+	"github.com/merisho/quest/scheduler"
+	"github.com/merisho/quest/storage"
+	"github.com/merisho/quest/transport"
 	"log"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -12,11 +18,58 @@ type Config struct {
 	UserID string
 	WrongAnswersForClue int
 	IntroMessage string
+	CloseAnswerMessage string
 	OutroMessage string
+	// OutroMessageDelay is a time.Duration, not a number of seconds: 5 * time.Second, not 5
 	OutroMessageDelay time.Duration
+	Storage storage.Storage
+	Clock scheduler.Clock
 }
 
-func NewPlayer(conf Config, cb *commandbus.CommandBus, q *quest.Quest, out io.Writer) *Player {
+func NewPlayer(conf Config, cb *commandbus.CommandBus, q *quest.Quest, out transport.Output) *Player {
+	p := newPlayer(conf, cb, q, out)
+
+	now := p.clock.Now()
+	p.startedAt = now
+	p.taskStartedAt = now
+
+	p.IntroMessage()
+
+	q.Start()
+	p.save()
+
+	p.scheduleClue()
+	p.handleCommands()
+
+	return p
+}
+
+func RestorePlayer(conf Config, cb *commandbus.CommandBus, q *quest.Quest, out transport.Output, snap storage.Snapshot) (*Player, error) {
+	p := newPlayer(conf, cb, q, out)
+
+	for m, t := range snap.Tries {
+		p.tries[m] = t
+	}
+	for m, c := range snap.Clues {
+		p.clues[m] = c
+	}
+	p.introSent = snap.IntroSent
+	p.outroSent = snap.OutroSent
+	p.startedAt = snap.StartedAt
+	p.taskStartedAt = snap.TaskStartedAt
+
+	if err := q.ResumeEntry(snap.Mission, snap.Task, snap.Entry); err != nil {
+		p.Destroy()
+		return nil, err
+	}
+
+	p.scheduleClue()
+	p.handleCommands()
+
+	return p, nil
+}
+
+func newPlayer(conf Config, cb *commandbus.CommandBus, q *quest.Quest, out transport.Output) *Player {
 	onlyThisUser := func(command *commandbus.Command) bool {
 		return command.UserID == conf.UserID
 	}
@@ -24,31 +77,36 @@ func NewPlayer(conf Config, cb *commandbus.CommandBus, q *quest.Quest, out io.Wr
 		return command.UserID != conf.UserID
 	}
 
-	answerSub := cb.FilterSubscribe("a", onlyThisUser)
-	adminMsgs := cb.FilterSubscribe("adminmsg", onlyOtherUsers)
+	ctx, cancel := context.WithCancel(context.Background())
+	// the player may be busy with delayed messages, but must not miss any answer
+	policy := commandbus.Policy{Delivery: commandbus.UnboundedDelivery}
+	answerSub := cb.FilterSubscribeWith(ctx, "a", policy, onlyThisUser)
+	adminMsgs := cb.FilterSubscribeWith(ctx, "adminmsg", policy, onlyOtherUsers)
+
+	sched := scheduler.NewScheduler(conf.Clock)
+	q.UseScheduler(sched)
 
-	p := &Player{
+	return &Player{
 		cb: cb,
 		userID: conf.UserID,
 		answer: answerSub,
 		adminMsgs: adminMsgs,
 		quest: q,
 		tries: make(map[string]int),
+		clues: make(map[string]int),
 		triesForClue: conf.WrongAnswersForClue,
+		closeMsg: conf.CloseAnswerMessage,
 		out: out,
-		destroy: make(chan struct{}),
+		done: ctx.Done(),
+		destroy: cancel,
+		clueDue: make(chan struct{}, 1),
 		introMsg: conf.IntroMessage,
 		outroMsg: conf.OutroMessage,
 		outroMsgDelay: conf.OutroMessageDelay,
+		storage: conf.Storage,
+		sched: sched,
+		clock: sched.Clock(),
 	}
-
-	p.IntroMessage()
-
-	q.Start()
-
-	p.handleCommands()
-
-	return p
 }
 
 type Player struct {
@@ -58,12 +116,28 @@ type Player struct {
 	adminMsgs chan *commandbus.Command
 	quest *quest.Quest
 	tries map[string]int
+	clues map[string]int
 	triesForClue int
-	out io.Writer
-	destroy chan struct{}
+	closeMsg string
+	out transport.Output
+	done <-chan struct{}
+	// destroy cancels the subscriptions of the player
+	destroy context.CancelFunc
+	clueTimer scheduler.Timer
+	clueDue chan struct{}
 	introMsg string
+	introSent bool
 	outroMsg string
+	outroSent bool
 	outroMsgDelay time.Duration
+	storage storage.Storage
+	// saving is held while the progress is saved, so a destroyed
+	// player never saves over the progress of the one replacing it
+	saving sync.Mutex
+	sched *scheduler.Scheduler
+	clock scheduler.Clock
+	startedAt time.Time
+	taskStartedAt time.Time
 }
 
 func (p *Player) UserID() string {
@@ -71,14 +145,30 @@ func (p *Player) UserID() string {
 }
 
 func (p *Player) handleCommands() {
+	answers, adminMsgs := p.answer, p.adminMsgs
+
 	go func() {
 		for {
 			select {
-			case a := <- p.answer:
+			case a, ok := <- answers:
+				// a closed subscription is removed from the bus, it is not read any more
+				if !ok {
+					answers = nil
+					continue
+				}
 				p.Answer(a)
-			case msg := <- p.adminMsgs:
+			case msg, ok := <- adminMsgs:
+				if !ok {
+					adminMsgs = nil
+					continue
+				}
 				p.Write(msg.Input)
-			case <- p.destroy:
+			case <- p.clueDue:
+				p.unlockClues()
+				p.scheduleClue()
+				p.save()
+			case <- p.done:
+				p.stopClueTimer()
 				return
 			}
 		}
@@ -94,43 +184,250 @@ func (p *Player) Answer(ans *commandbus.Command) {
 		return
 	}
 
-	res := p.quest.Answer(ans.Input)
-	if !res {
-		p.tries[p.MissionName()]++
-		if p.tries[p.MissionName()] == p.triesForClue {
-			p.Write(p.quest.Clue())
+	// a button of a task passed before is stale, it answers nothing
+	if task := ans.ServiceData["task"]; task != "" && task != p.quest.TaskKey() {
+		return
+	}
+
+	mission := p.MissionName()
+	task := p.quest.TaskIndex()
+
+	var res quest.AnswerResult
+	if ans.Location != nil {
+		res = p.quest.AnswerLocation(transport.Point{
+			Latitude: ans.Location.Latitude,
+			Longitude: ans.Location.Longitude,
+		})
+	} else {
+		res = p.quest.Answer(ans.Input)
+	}
+
+	if res == quest.CloseAnswer {
+		replyTo, _ := strconv.Atoi(ans.ServiceData["messageID"])
+		p.closeAnswerMessage(replyTo)
+	}
+
+	// a live location is updated as the player moves, it is not
+	// a wrong answer until the player reaches the place
+	live := ans.ServiceData["live"] != ""
+	if !res.Correct() && !live {
+		p.tries[mission]++
+		p.unlockClues()
+	}
+
+	if p.Finished() || p.MissionName() != mission || p.quest.TaskIndex() != task {
+		p.taskStartedAt = p.clock.Now()
+
+		// wrong answers and clues are counted for the current task only
+		if !p.Finished() {
+			delete(p.tries, p.MissionName())
+			delete(p.clues, p.MissionName())
 		}
 	}
 
 	if p.Finished() {
 		p.OutroMessage()
 	}
+
+	p.scheduleClue()
+	p.save()
 }
 
-func (p *Player) Write(s string) {
-	_, err := p.out.Write([]byte(s))
-	if err != nil {
-		log.Println(err)
+// ClueTier is the number of clue tiers unlocked for the current task
+func (p *Player) ClueTier() int {
+	if p.Finished() {
+		return 0
+	}
+
+	return p.clues[p.MissionName()]
+}
+
+func (p *Player) unlockClues() {
+	mission := p.MissionName()
+	clues := p.quest.Clues()
+
+	for p.clues[mission] < len(clues) {
+		tier := p.clues[mission]
+		if !p.clueUnlocked(clues[tier]) {
+			return
+		}
+
+		p.Send(clues[tier].Text.Outgoing(transport.ClueMessage))
+		p.clues[mission]++
+
+		p.cb.Publish(
+			fmt.Sprintf("/cluetier %d", tier + 1),
+			p.userID,
+			[2]string{"mission", mission},
+			[2]string{"tiers", strconv.Itoa(len(clues))},
+		)
+	}
+}
+
+// scheduleClue arms the timer for the next tier of clues
+// of the current task if the tier is unlocked by time
+func (p *Player) scheduleClue() {
+	p.stopClueTimer()
+
+	if p.Finished() {
+		return
+	}
+
+	clues := p.quest.Clues()
+	tier := p.clues[p.MissionName()]
+	if tier >= len(clues) || clues[tier].AfterTime == 0 {
+		return
+	}
+
+	wait := p.taskStartedAt.Add(clues[tier].AfterTime.Duration()).Sub(p.clock.Now())
+	if wait < 0 {
+		wait = 0
+	}
+
+	p.clueTimer = p.clock.AfterFunc(wait, func() {
+		select {
+		case p.clueDue <- struct{}{}:
+		default:
+		}
+	})
+}
+
+func (p *Player) stopClueTimer() {
+	if p.clueTimer != nil {
+		p.clueTimer.Stop()
+		p.clueTimer = nil
 	}
 }
 
+func (p *Player) clueUnlocked(c quest.ClueDescription) bool {
+	tries := p.tries[p.MissionName()]
+	if c.AfterWrongAnswers == 0 && c.AfterTime == 0 {
+		return p.triesForClue > 0 && tries >= p.triesForClue
+	}
+
+	if c.AfterWrongAnswers > 0 && tries >= c.AfterWrongAnswers {
+		return true
+	}
+
+	return c.AfterTime > 0 && p.clock.Now().Sub(p.taskStartedAt) >= c.AfterTime.Duration()
+}
+
+// Write queues the text after the messages already scheduled for the player
+func (p *Player) Write(s string) {
+	p.WriteAfter(0, s)
+}
+
+func (p *Player) WriteAfter(delay time.Duration, s string) {
+	p.SendAfter(delay, transport.Outgoing{
+		Text: s,
+		Kind: transport.SystemMessage,
+	})
+}
+
+// Send queues the message after the messages already scheduled for the player
+func (p *Player) Send(msg transport.Outgoing) {
+	p.SendAfter(0, msg)
+}
+
+func (p *Player) SendAfter(delay time.Duration, msg transport.Outgoing) {
+	p.sched.After(delay, func() {
+		err := p.out.Send(msg)
+		if err != nil {
+			log.Println(err)
+		}
+	})
+}
+
 func (p *Player) Finished() bool {
 	return p.quest.Finished()
 }
 
 func (p *Player) Destroy() {
-	close(p.destroy)
+	p.saving.Lock()
+	p.destroy()
+	p.saving.Unlock()
+
+	p.sched.Cancel()
 }
 
 func (p *Player) IntroMessage() {
 	if p.introMsg != "" {
 		p.Write(p.introMsg)
 	}
+
+	p.introSent = true
+}
+
+func (p *Player) CloseAnswerMessage() {
+	p.closeAnswerMessage(0)
+}
+
+// closeAnswerMessage replies to the message with the close answer, if it is known
+func (p *Player) closeAnswerMessage(replyTo int) {
+	msg := p.quest.CloseMessage()
+	if msg.Empty() {
+		msg = quest.Message{Text: p.closeMsg}
+	}
+
+	if !msg.Empty() {
+		out := msg.Outgoing(transport.SystemMessage)
+		out.ReplyTo = replyTo
+		p.Send(out)
+	}
 }
 
 func (p *Player) OutroMessage() {
 	if p.outroMsg != "" {
-		time.Sleep(p.outroMsgDelay * time.Second)
-		p.Write(p.outroMsg)
+		p.WriteAfter(p.outroMsgDelay, p.outroMsg)
+	}
+
+	p.outroSent = true
+}
+
+func (p *Player) Snapshot() storage.Snapshot {
+	snap := storage.Snapshot{
+		UserID: p.userID,
+		Tries: make(map[string]int),
+		Clues: make(map[string]int),
+		IntroSent: p.introSent,
+		Finished: p.Finished(),
+		OutroSent: p.outroSent,
+		StartedAt: p.startedAt,
+		TaskStartedAt: p.taskStartedAt,
+		UpdatedAt: p.clock.Now(),
+	}
+
+	if !snap.Finished {
+		snap.Mission = p.MissionName()
+		snap.Task = p.quest.TaskIndex()
+		snap.Entry = p.quest.Entry()
+	}
+
+	for m, t := range p.tries {
+		snap.Tries[m] = t
+	}
+	for m, c := range p.clues {
+		snap.Clues[m] = c
+	}
+
+	return snap
+}
+
+func (p *Player) save() {
+	if p.storage == nil {
+		return
+	}
+
+	p.saving.Lock()
+	defer p.saving.Unlock()
+
+	select {
+	case <- p.done:
+		return
+	default:
+	}
+
+	if err := p.storage.Save(p.Snapshot()); err != nil {
+		log.Println(err)
 	}
 }
@@ -1,11 +1,18 @@
 package player
 
 import (
-	"bytes"
 	"github.com/merisho/quest/commandbus"
 	"github.com/merisho/quest/quest"
+	"github.com/merisho/quest/scheduler"
+	"github.com/merisho/quest/storage"
+	"github.com/merisho/quest/transport"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -19,103 +26,542 @@ var conf = Config{
 	UserID: userID,
 	WrongAnswersForClue: 3,
 	IntroMessage: "intro message",
+	CloseAnswerMessage: "very close",
 	OutroMessage: "outro message",
 }
 
 func TestHandleAnswer(t *testing.T) {
 	cb := commandbus.NewCommandBus()
-	buf := bytes.NewBuffer(nil)
-	q, _ := quest.NewQuestFromFile(questFile, buf)
+	out := &recordingOutput{}
+	q, _ := quest.NewQuestFromFile(questFile, out)
 
-	player := NewPlayer(conf, cb, q, buf)
-	time.Sleep(1)
+	player := NewPlayer(conf, cb, q, out)
 
 	assert.Equal(t, "Mission 1", player.MissionName())
 
 	cb.Publish("/a answer 1", userID)
-	time.Sleep(1)
-
-	assert.Equal(t, "Mission 2", player.MissionName())
+	assert.Eventually(t, out.has("task 2"), time.Second, time.Millisecond, out.String())
 
 	cb.Publish("/a answer 2", userID)
-	time.Sleep(1)
-
-	assert.True(t, player.Finished())
+	assert.Eventually(t, out.has(conf.OutroMessage), time.Second, time.Millisecond, out.String())
 }
 
 func TestClueAfter3WrongAnswers(t *testing.T) {
 	cb := commandbus.NewCommandBus()
-	buf := bytes.NewBuffer(nil)
+	out := &recordingOutput{}
 
-	q, _ := quest.NewQuestFromFile(questFile, buf)
-	NewPlayer(conf, cb, q, buf)
+	q, _ := quest.NewQuestFromFile(questFile, out)
+	NewPlayer(conf, cb, q, out)
 
 	cb.Publish("/a 111", userID)
-	time.Sleep(1)
 	cb.Publish("/a 111", userID)
-	time.Sleep(1)
 	cb.Publish("/a 111", userID)
-	time.Sleep(1)
 
-	str := "clue 1"
-	assert.True(t, strings.Contains(buf.String(), str), buf.String())
+	assert.Eventually(t, out.has("clue 1"), time.Second, time.Millisecond, out.String())
 }
 
 func TestDestroyPlayer(t *testing.T) {
 	cb := commandbus.NewCommandBus()
-	buf := bytes.NewBuffer(nil)
+	out := &recordingOutput{}
+
+	q, _ := quest.NewQuestFromFile(questFile, out)
+	p := NewPlayer(conf, cb, q, out)
+
+	p.Destroy()
+	assert.Eventually(t, func() bool {
+		return cb.SubscriptionsCount("a") == 0
+	}, time.Second, time.Millisecond)
 
-	q, _ := quest.NewQuestFromFile(questFile, buf)
-	p := NewPlayer(conf, cb, q, buf)
+	cb.Publish("/a answer 1", userID)
 
-	time.Sleep(1)
+	assert.False(t, out.has("task 2")(), "must NOT handle anything after it is destroyed")
+}
 
-	m := p.MissionName()
+func TestDestroyRemovesSubscriptions(t *testing.T) {
+	cb := commandbus.NewCommandBus()
+	out := &recordingOutput{}
+	before := runtime.NumGoroutine()
+
+	q, _ := quest.NewQuestFromFile(questFile, out)
+	p := NewPlayer(conf, cb, q, out)
+	assert.Equal(t, 1, cb.SubscriptionsCount("a"))
 
 	p.Destroy()
-	time.Sleep(1)
 
+	assert.Eventually(t, func() bool {
+		return cb.SubscriptionsCount("a") == 0 && cb.SubscriptionsCount("adminmsg") == 0
+	}, time.Second, time.Millisecond, "must unsubscribe")
+	// the condition runs in a goroutine of assert.Eventually
+	assert.Eventually(t, func() bool {
+		return runtime.NumGoroutine() <= before + 1
+	}, time.Second, time.Millisecond, "must stop the goroutines of the player")
+}
+
+type slowOutput struct {
+	transport.Output
+	delay time.Duration
+}
+
+func (o slowOutput) Send(msg transport.Outgoing) error {
+	time.Sleep(o.delay)
+	return o.Output.Send(msg)
+}
+
+func TestBusyPlayerGetsAnswers(t *testing.T) {
+	cb := commandbus.NewCommandBus()
+	rec := &recordingOutput{}
+	out := slowOutput{rec, 30 * time.Millisecond}
+
+	q, _ := quest.NewQuestFromFile(questFile, out)
+	NewPlayer(conf, cb, q, out)
+
+	// the player is busy sending the messages of Mission 2 while the answer comes
 	cb.Publish("/a answer 1", userID)
-	time.Sleep(1)
+	cb.Publish("/a answer 2", userID)
 
-	assert.Equal(t, m, p.MissionName(), "must NOT handle anything after it is destroyed")
+	assert.Eventually(t, rec.has(conf.OutroMessage), time.Second, time.Millisecond)
 }
 
 func TestIntroMessage(t *testing.T) {
 	cb := commandbus.NewCommandBus()
-	buf := bytes.NewBuffer(nil)
+	out := &recordingOutput{}
 
-	q, _ := quest.NewQuestFromFile(questFile, buf)
-	NewPlayer(conf, cb, q, buf)
+	q, _ := quest.NewQuestFromFile(questFile, out)
+	NewPlayer(conf, cb, q, out)
 
-	assert.True(t, strings.Contains(buf.String(), conf.IntroMessage))
+	assert.True(t, out.has(conf.IntroMessage)())
 }
 
 func TestOutroMessage(t *testing.T) {
 	cb := commandbus.NewCommandBus()
-	buf := bytes.NewBuffer(nil)
+	out := &recordingOutput{}
 
-	q, _ := quest.NewQuestFromFile(questFile, buf)
-	NewPlayer(conf, cb, q, buf)
+	q, _ := quest.NewQuestFromFile(questFile, out)
+	NewPlayer(conf, cb, q, out)
 
 	cb.Publish("/a answer 1", userID)
-	time.Sleep(1)
 	cb.Publish("/a answer 2", userID)
-	time.Sleep(1)
 
-	assert.True(t, strings.Contains(buf.String(), conf.OutroMessage))
+	assert.Eventually(t, out.has(conf.OutroMessage), time.Second, time.Millisecond, out.String())
 }
 
 func TestAdminMessages(t *testing.T) {
 	cb := commandbus.NewCommandBus()
-	buf := bytes.NewBuffer(nil)
+	out := &recordingOutput{}
+
+	q, _ := quest.NewQuestFromFile(questFile, out)
+	NewPlayer(conf, cb, q, out)
+
+	cb.Publish("/adminmsg Hello from admin", "admin-id")
+
+	assert.Eventually(t, out.has("Hello from admin"), time.Second, time.Millisecond, out.String())
+}
+
+func newStorage(t *testing.T) *storage.FileStorage {
+	dir, err := ioutil.TempDir("", "quest-player")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	s, err := storage.NewFileStorage(filepath.Join(dir, "progress.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// saved is the progress of the player as it was saved last. The player saves it once an answer
+// is handled, so the test reads it there instead of the state the player is changing
+func saved(st storage.Storage) storage.Snapshot {
+	snap, _ := st.Load(userID)
+	return snap
+}
+
+func TestSavesProgress(t *testing.T) {
+	cb := commandbus.NewCommandBus()
+	out := &recordingOutput{}
+	st := newStorage(t)
+
+	c := conf
+	c.Storage = st
+
+	q, _ := quest.NewQuestFromFile(questFile, out)
+	NewPlayer(c, cb, q, out)
+
+	snap, err := st.Load(userID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Mission 1", snap.Mission)
+	assert.True(t, snap.IntroSent)
+	assert.False(t, snap.StartedAt.IsZero())
+
+	cb.Publish("/a wrong", userID)
+	cb.Publish("/a answer 1", userID)
+	assert.Eventually(t, func() bool {
+		return saved(st).Mission == "Mission 2"
+	}, time.Second, time.Millisecond)
+
+	assert.Equal(t, 1, saved(st).Tries["Mission 1"])
+	assert.Equal(t, 2, saved(st).Entry, "must save the entry the buttons of the task are keyed by")
+}
+
+func TestDestroyedPlayerDoesNotSave(t *testing.T) {
+	cb := commandbus.NewCommandBus()
+	out := &recordingOutput{}
+	st := newStorage(t)
+
+	c := conf
+	c.Storage = st
+
+	q, _ := quest.NewQuestFromFile(questFile, out)
+	p := NewPlayer(c, cb, q, out)
+
+	p.Destroy()
+
+	// the player replacing the destroyed one saves its progress first
+	st.Save(storage.Snapshot{UserID: userID, Mission: "Mission 2"})
+	p.save()
+
+	snap, err := st.Load(userID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Mission 2", snap.Mission, "must NOT save over the progress of the new player")
+}
+
+func TestRestorePlayer(t *testing.T) {
+	cb := commandbus.NewCommandBus()
+	out := &recordingOutput{}
+
+	snap := storage.Snapshot{
+		UserID: userID,
+		Mission: "Mission 2",
+		Tries: map[string]int{"Mission 2": 2},
+		IntroSent: true,
+	}
+
+	q, _ := quest.NewQuestFromFile(questFile, out)
+	p, err := RestorePlayer(conf, cb, q, out, snap)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "Mission 2", p.MissionName())
+	assert.False(t, out.has(conf.IntroMessage)(), "must NOT repeat intro message")
+	assert.True(t, out.has("task 2")(), "must repeat the statement of current mission")
+
+	cb.Publish("/a 111", userID)
+	assert.Eventually(t, out.has("clue 2"), time.Second, time.Millisecond, "must continue counting restored wrong answers")
+}
+
+func TestRestoreUnknownMission(t *testing.T) {
+	cb := commandbus.NewCommandBus()
+	out := &recordingOutput{}
+
+	q, _ := quest.NewQuestFromFile(questFile, out)
+	p, err := RestorePlayer(conf, cb, q, out, storage.Snapshot{UserID: userID, Mission: "Mission 42"})
+	assert.Error(t, err)
+	assert.Nil(t, p)
+}
+
+func TestCloseAnswerMessage(t *testing.T) {
+	cb := commandbus.NewCommandBus()
+	out := &recordingOutput{}
+
+	q, _ := quest.NewQuestFromFile("./test-fuzzy-quest.json", out)
+	NewPlayer(conf, cb, q, out)
+
+	cb.Publish("/a answer 11", userID)
+
+	assert.Eventually(t, out.has(conf.CloseAnswerMessage), time.Second, time.Millisecond, out.String())
+	// the statement of the next mission would come before the message
+	assert.False(t, out.has("task 2")(), "close answer must NOT pass the mission")
+}
+
+// recordingOutput keeps the messages sent to the player,
+// the test reads them while the player goroutine sends more
+type recordingOutput struct {
+	mu sync.Mutex
+	msgs []transport.Outgoing
+}
+
+func (o *recordingOutput) Send(msg transport.Outgoing) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.msgs = append(o.msgs, msg)
+	return nil
+}
+
+func (o *recordingOutput) messages() []transport.Outgoing {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]transport.Outgoing(nil), o.msgs...)
+}
+
+func (o *recordingOutput) last() transport.Outgoing {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.msgs[len(o.msgs) - 1]
+}
+
+// String is the text of the messages as a transport.WriterOutput writes them
+func (o *recordingOutput) String() string {
+	var b strings.Builder
+	for _, msg := range o.messages() {
+		b.WriteString(msg.String())
+	}
+
+	return b.String()
+}
+
+// has is the condition for assert.Eventually that the text was sent
+func (o *recordingOutput) has(text string) func() bool {
+	return func() bool {
+		return strings.Contains(o.String(), text)
+	}
+}
+
+// endsWith is the condition for assert.Eventually that the text was sent last
+func (o *recordingOutput) endsWith(text string) func() bool {
+	return func() bool {
+		return strings.HasSuffix(o.String(), text)
+	}
+}
+
+func TestMessageKinds(t *testing.T) {
+	cb := commandbus.NewCommandBus()
+	out := &recordingOutput{}
+
+	q, _ := quest.NewQuestFromFile("./test-fuzzy-quest.json", out)
+	NewPlayer(conf, cb, q, out)
+
+	msgs := out.messages()
+	assert.Equal(t, transport.SystemMessage, msgs[0].Kind, "intro")
+	assert.Equal(t, transport.StoryMessage, msgs[1].Kind, "mission start")
+	assert.Equal(t, transport.StatementMessage, msgs[2].Kind, "statement")
+
+	cb.Publish("/a answer 11", userID, [2]string{"messageID", "42"})
+	assert.Eventually(t, out.has(conf.CloseAnswerMessage), time.Second, time.Millisecond)
+
+	assert.Equal(t, transport.Outgoing{
+		Text: conf.CloseAnswerMessage,
+		Kind: transport.SystemMessage,
+		ReplyTo: 42,
+	}, out.last(), "close answer must reply to the answer")
+
+	cb.Publish("/a wrong", userID)
+	cb.Publish("/a wrong", userID)
+	assert.Eventually(t, func() bool {
+		return out.last().Kind == transport.ClueMessage
+	}, time.Second, time.Millisecond)
+}
+
+func TestClueTiers(t *testing.T) {
+	cb := commandbus.NewCommandBus()
+	out := &recordingOutput{}
+	st := newStorage(t)
+	tiers := cb.Subscribe("cluetier")
+
+	c := conf
+	c.Storage = st
+
+	q, _ := quest.NewQuestFromFile("./test-clues-quest.json", out)
+	NewPlayer(c, cb, q, out)
+
+	cb.Publish("/a 111", userID)
+	tier := <- tiers
+	assert.Equal(t, "1", tier.Input)
+	assert.Equal(t, "Mission 1", tier.ServiceData["mission"])
+	assert.Equal(t, "3", tier.ServiceData["tiers"])
+	// the tier is published once its clue is sent
+	assert.True(t, out.endsWith("clue 1.1")(), out.String())
+
+	cb.Publish("/a 111", userID)
+	<- tiers
+	assert.True(t, out.endsWith("clue 1.2")(), out.String())
+
+	cb.Publish("/a 111", userID)
+	assert.Eventually(t, func() bool {
+		return saved(st).Tries["Mission 1"] == 3
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 2, saved(st).Clues["Mission 1"], "reveal must wait for its own number of wrong answers")
+
+	cb.Publish("/a 111", userID)
+	tier = <- tiers
+	assert.Equal(t, "3", tier.Input)
+	assert.True(t, out.endsWith("answer 1")(), "reveal tier must disclose the answer")
+
+	cb.Publish("/a answer 1", userID)
+	assert.Eventually(t, func() bool {
+		return saved(st).Mission == "Mission 2"
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 0, saved(st).Clues["Mission 2"], "next mission must start from the first tier")
+
+	cb.Publish("/a 111", userID)
+	<- tiers
+	assert.True(t, out.endsWith("clue 2.1")(), out.String())
+}
+
+func TestIdleClue(t *testing.T) {
+	cb := commandbus.NewCommandBus()
+	out := &recordingOutput{}
+	clock := scheduler.NewFakeClock(time.Now())
+	tiers := cb.Subscribe("cluetier")
+
+	c := conf
+	c.Clock = clock
+
+	q, _ := quest.NewQuestFromFile("./test-idle-quest.json", out)
+	NewPlayer(c, cb, q, out)
+
+	clock.Advance(999 * time.Millisecond)
+	assert.Equal(t, 1, clock.Pending(), "clue must wait for its time")
+	assert.False(t, out.has("idle clue 1")())
+
+	clock.Advance(time.Millisecond)
+	tier := <- tiers
+	assert.Equal(t, "1", tier.Input)
+	assert.True(t, out.endsWith("idle clue 1")(), out.String())
+}
+
+func TestIdleClueIsResetOnMissionChange(t *testing.T) {
+	cb := commandbus.NewCommandBus()
+	out := &recordingOutput{}
+	st := newStorage(t)
+	clock := scheduler.NewFakeClock(time.Now())
 
-	q, _ := quest.NewQuestFromFile(questFile, buf)
-	NewPlayer(conf, cb, q, buf)
-	time.Sleep(1)
+	c := conf
+	c.Clock = clock
+	c.Storage = st
+
+	q, _ := quest.NewQuestFromFile("./test-idle-quest.json", out)
+	NewPlayer(c, cb, q, out)
+
+	clock.Advance(500 * time.Millisecond)
+	cb.Publish("/a answer 1", userID)
+	assert.Eventually(t, func() bool {
+		return saved(st).Mission == "Mission 2"
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 1, clock.Pending(), "timer of the previous mission must be cancelled")
+
+	clock.Advance(500 * time.Millisecond)
+	assert.False(t, out.has("idle clue")(), "clue must wait for the time of the new mission")
+
+	clock.Advance(500 * time.Millisecond)
+	assert.Eventually(t, out.endsWith("idle clue 2"), time.Second, time.Millisecond, out.String())
+}
+
+func TestIdleClueIsCancelledOnDestroy(t *testing.T) {
+	cb := commandbus.NewCommandBus()
+	out := &recordingOutput{}
+	clock := scheduler.NewFakeClock(time.Now())
+
+	c := conf
+	c.Clock = clock
+
+	q, _ := quest.NewQuestFromFile("./test-idle-quest.json", out)
+	p := NewPlayer(c, cb, q, out)
+	p.Destroy()
+
+	// the player goroutine stops the timer once it sees the player destroyed
+	assert.Eventually(t, func() bool {
+		return clock.Pending() == 0
+	}, time.Second, time.Millisecond)
+
+	clock.Advance(time.Minute)
+
+	assert.False(t, out.has("idle clue 1")())
+}
+
+func TestDelayedOutroMessage(t *testing.T) {
+	cb := commandbus.NewCommandBus()
+	out := &recordingOutput{}
+	clock := scheduler.NewFakeClock(time.Now())
+
+	c := conf
+	c.Clock = clock
+	c.OutroMessageDelay = 5 * time.Second
+
+	q, _ := quest.NewQuestFromFile(questFile, out)
+	p := NewPlayer(c, cb, q, out)
+
+	cb.Publish("/a answer 1", userID)
+	cb.Publish("/a answer 2", userID)
+
+	// the outro message waits for its delay on the clock once the quest is finished
+	assert.Eventually(t, func() bool {
+		return clock.Pending() == 1
+	}, time.Second, time.Millisecond)
+	assert.False(t, out.has(conf.OutroMessage)())
 
 	cb.Publish("/adminmsg Hello from admin", "admin-id")
-	time.Sleep(1)
+	assert.Eventually(t, func() bool {
+		return p.sched.Pending() == 2
+	}, time.Second, time.Millisecond)
+	assert.False(t, out.has("Hello from admin")(), "must keep the order of messages")
+
+	clock.Advance(5 * time.Second)
+	assert.True(t, out.endsWith(conf.OutroMessage + "Hello from admin")(), out.String())
+}
+
+func TestDestroyCancelsDelayedMessages(t *testing.T) {
+	cb := commandbus.NewCommandBus()
+	out := &recordingOutput{}
+	clock := scheduler.NewFakeClock(time.Now())
+
+	c := conf
+	c.Clock = clock
+	c.OutroMessageDelay = 5 * time.Second
 
-	assert.True(t, strings.Contains(buf.String(), "Hello from admin"))
+	q, _ := quest.NewQuestFromFile(questFile, out)
+	p := NewPlayer(c, cb, q, out)
+
+	cb.Publish("/a answer 1", userID)
+	cb.Publish("/a answer 2", userID)
+	assert.Eventually(t, func() bool {
+		return clock.Pending() == 1
+	}, time.Second, time.Millisecond)
+
+	p.Destroy()
+	clock.Advance(5 * time.Second)
+
+	assert.False(t, out.has(conf.OutroMessage)())
+}
+
+func TestLocationAnswer(t *testing.T) {
+	cb := commandbus.NewCommandBus()
+	out := &recordingOutput{}
+	st := newStorage(t)
+
+	c := conf
+	c.Storage = st
+
+	q, _ := quest.NewQuestFromFile("./test-location-quest.json", out)
+	NewPlayer(c, cb, q, out)
+
+	cb.PublishCommand(&commandbus.Command{
+		Type: "a",
+		UserID: userID,
+		Location: &commandbus.Location{Latitude: 55.7520, Longitude: 37.6175},
+		ServiceData: map[string]string{"live": "true"},
+	})
+	cb.PublishCommand(&commandbus.Command{
+		Type: "a",
+		UserID: userID,
+		Location: &commandbus.Location{Latitude: 55.7520, Longitude: 37.6175},
+	})
+	cb.PublishCommand(&commandbus.Command{
+		Type: "a",
+		UserID: userID,
+		Location: &commandbus.Location{Latitude: 55.7545, Longitude: 37.6210},
+		ServiceData: map[string]string{"live": "true"},
+	})
+
+	assert.Eventually(t, func() bool {
+		return saved(st).Finished
+	}, time.Second, time.Millisecond)
+	// the wrong answers of the last task are kept once the quest is finished
+	assert.Equal(t, 1, saved(st).Tries["Mission 1"], "live location far from the place is not a wrong answer")
 }
@@ -0,0 +1,207 @@
+package quest
+
+import (
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Normalization steps which may be listed in the "normalize" field of a task
+const (
+	NormalizeUnicode = "unicode"
+	NormalizeTrim = "trim"
+	NormalizeFoldCase = "foldCase"
+	NormalizeYo = "yo"
+	NormalizeStripPunctuation = "stripPunctuation"
+	NormalizeCollapseWhitespace = "collapseWhitespace"
+)
+
+var defaultNormalization = []string{
+	NormalizeUnicode,
+	NormalizeTrim,
+	NormalizeCollapseWhitespace,
+	NormalizeFoldCase,
+	NormalizeYo,
+}
+
+var normalizers = map[string]func(string) string{
+	NormalizeUnicode: norm.NFKC.String,
+	NormalizeTrim: strings.TrimSpace,
+	NormalizeFoldCase: strings.ToLower,
+	NormalizeYo: strings.NewReplacer("ё", "е", "Ё", "Е").Replace,
+	NormalizeStripPunctuation: func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if unicode.IsPunct(r) {
+				return -1
+			}
+			return r
+		}, s)
+	},
+	NormalizeCollapseWhitespace: func(s string) string {
+		return strings.Join(strings.Fields(s), " ")
+	},
+}
+
+type answerMatcher struct {
+	normalize []func(string) string
+	answers map[string]bool
+	patterns []*regexp.Regexp
+}
+
+func newAnswerMatcher(td TaskDescription) (*answerMatcher, error) {
+	steps := td.Normalize
+	if steps == nil {
+		steps = defaultNormalization
+	}
+
+	m := &answerMatcher{
+		answers: make(map[string]bool),
+	}
+
+	for _, s := range steps {
+		n, ok := normalizers[s]
+		if !ok {
+			return nil, fmt.Errorf("unknown normalization %q", s)
+		}
+
+		m.normalize = append(m.normalize, n)
+	}
+
+	for _, a := range td.answers() {
+		m.answers[m.normalized(a)] = true
+	}
+
+	for _, p := range td.AnswerPatterns {
+		re, err := regexp.Compile(patternSource(p, steps))
+		if err != nil {
+			return nil, fmt.Errorf("invalid answer pattern %q: %s", p, err)
+		}
+
+		m.patterns = append(m.patterns, re)
+	}
+
+	return m, nil
+}
+
+// patternSource adapts the answer pattern to the normalization, since patterns
+// are matched against the normalized answer. The pattern ignores case if the case
+// is folded, and ё in it is е if ё is replaced. Other steps are not applied to patterns
+func patternSource(p string, steps []string) string {
+	for _, s := range steps {
+		switch s {
+		case NormalizeUnicode, NormalizeYo:
+			p = normalizers[s](p)
+		case NormalizeFoldCase:
+			if !strings.HasPrefix(p, "(?i)") {
+				p = "(?i)" + p
+			}
+		}
+	}
+
+	return p
+}
+
+func (m *answerMatcher) normalized(s string) string {
+	for _, n := range m.normalize {
+		s = n(s)
+	}
+
+	return s
+}
+
+// oneOf reports whether the answer is equal to any of the given answers
+// after both are normalized with the pipeline of the task
+func (m *answerMatcher) oneOf(answer string, answers []string) bool {
+	answer = m.normalized(answer)
+	for _, a := range answers {
+		if answer == m.normalized(a) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *answerMatcher) match(answer string) bool {
+	answer = m.normalized(answer)
+	if answer == "" {
+		return false
+	}
+
+	if m.answers[answer] {
+		return true
+	}
+
+	for _, re := range m.patterns {
+		if re.MatchString(answer) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// similarity is 1 for equal strings and goes down to 0 as
+// the edit distance between the strings grows
+func (m *answerMatcher) similarity(answer string, answers []string) float64 {
+	answer = m.normalized(answer)
+	best := 0.0
+	for _, a := range answers {
+		a = m.normalized(a)
+
+		l := len([]rune(a))
+		if al := len([]rune(answer)); al > l {
+			l = al
+		}
+		if l == 0 {
+			continue
+		}
+
+		s := 1 - float64(editDistance(answer, a)) / float64(l)
+		if s > best {
+			best = s
+		}
+	}
+
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b counted in runes
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	prev := make([]int, len(rb) + 1)
+	curr := make([]int, len(rb) + 1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i - 1] == rb[j - 1] {
+				cost = 0
+			}
+
+			curr[j] = minInt(prev[j] + 1, curr[j - 1] + 1, prev[j - 1] + cost)
+		}
+
+		prev, curr = curr, prev
+	}
+
+	return prev[len(rb)]
+}
+
+func minInt(first int, rest ...int) int {
+	m := first
+	for _, v := range rest {
+		if v < m {
+			m = v
+		}
+	}
+
+	return m
+}
@@ -0,0 +1,96 @@
+package quest
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDefaultNormalization(t *testing.T) {
+	m, err := newAnswerMatcher(TaskDescription{CorrectAnswer: "Ёлка  Большая"})
+	assert.NoError(t, err)
+
+	assert.True(t, m.match("ёлка большая"), "correct answer with capital letters must match")
+	assert.True(t, m.match("  елка   БОЛЬШАЯ "))
+	assert.False(t, m.match("елка"))
+	assert.False(t, m.match(""))
+}
+
+func TestUnicodeNormalization(t *testing.T) {
+	m, _ := newAnswerMatcher(TaskDescription{CorrectAnswer: "café"})
+
+	assert.True(t, m.match("café"), "decomposed form must match the composed one")
+}
+
+func TestCustomNormalization(t *testing.T) {
+	m, err := newAnswerMatcher(TaskDescription{
+		CorrectAnswer: "Hello, World",
+		Normalize: []string{NormalizeFoldCase, NormalizeStripPunctuation},
+	})
+	assert.NoError(t, err)
+
+	assert.True(t, m.match("hello world"))
+	assert.True(t, m.match("HELLO WORLD!"))
+	assert.False(t, m.match(" hello world"), "must NOT trim when trim is not listed")
+}
+
+func TestStrictNormalization(t *testing.T) {
+	m, _ := newAnswerMatcher(TaskDescription{
+		CorrectAnswer: "Answer",
+		Normalize: []string{},
+	})
+
+	assert.True(t, m.match("Answer"))
+	assert.False(t, m.match("answer"), "empty pipeline must compare answers as is")
+}
+
+func TestCorrectAnswersList(t *testing.T) {
+	m, _ := newAnswerMatcher(TaskDescription{
+		CorrectAnswer: "four",
+		CorrectAnswers: []string{"4", "IV"},
+	})
+
+	assert.True(t, m.match("four"))
+	assert.True(t, m.match("4"))
+	assert.True(t, m.match("iv"))
+	assert.False(t, m.match("5"))
+}
+
+func TestAnswerPatterns(t *testing.T) {
+	m, err := newAnswerMatcher(TaskDescription{
+		AnswerPatterns: []string{`^1[89]\d\d$`},
+	})
+	assert.NoError(t, err)
+
+	assert.True(t, m.match(" 1905 "))
+	assert.False(t, m.match("2005"))
+}
+
+func TestAnswerPatternsWithCase(t *testing.T) {
+	m, err := newAnswerMatcher(TaskDescription{
+		AnswerPatterns: []string{`^Paris$`, `^Ёлка$`},
+	})
+	assert.NoError(t, err)
+
+	assert.True(t, m.match("Paris"), "pattern must match the answer written as in the pattern")
+	assert.True(t, m.match("PARIS"))
+	assert.True(t, m.match("ёлка"))
+	assert.True(t, m.match("Елка"))
+	assert.False(t, m.match("Paris, France"))
+
+	m, err = newAnswerMatcher(TaskDescription{
+		AnswerPatterns: []string{`^Paris$`},
+		Normalize: []string{NormalizeTrim},
+	})
+	assert.NoError(t, err)
+
+	assert.True(t, m.match("Paris"))
+	assert.False(t, m.match("paris"), "pattern must respect case if the case is not folded")
+}
+
+func TestInvalidMatcher(t *testing.T) {
+	_, err := newAnswerMatcher(TaskDescription{AnswerPatterns: []string{"("}})
+	assert.Error(t, err)
+
+	_, err = newAnswerMatcher(TaskDescription{Normalize: []string{"soundex"}})
+	assert.Error(t, err)
+}
@@ -0,0 +1,51 @@
+package quest
+
+import (
+	"fmt"
+	"github.com/merisho/quest/transport"
+	"hash/fnv"
+	"strings"
+)
+
+// taskKeySize is the length of the key of a task in the data of the buttons of its choices
+const taskKeySize = 8
+
+// maxChoice is the limit of the text of a choice in bytes, it goes
+// into the data of the button after the key of the task
+const maxChoice = transport.MaxButtonData - taskKeySize - 1
+
+// taskKey identifies the task in the data of the buttons, so the presses
+// of the keyboards of the tasks passed before can be told apart. The entry
+// tells apart the visits of a mission the branches lead back to
+func taskKey(mission string, task, entry int) string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s#%d#%d", mission, task, entry)
+
+	return fmt.Sprintf("%0*x", taskKeySize, h.Sum32())
+}
+
+func choiceData(key, choice string) string {
+	return key + ":" + choice
+}
+
+// ParseChoice splits the data of the button of a choice into the key of its task and
+// the text of the choice. The key is empty if the data has none, like the buttons
+// pressed in the console
+func ParseChoice(data string) (task, choice string) {
+	parts := strings.SplitN(data, ":", 2)
+	if len(parts) < 2 || len(parts[0]) != taskKeySize {
+		return "", data
+	}
+
+	return parts[0], parts[1]
+}
+
+// TaskKey identifies the current task, the answers given with the buttons
+// of other tasks must be ignored
+func (q *Quest) TaskKey() string {
+	if q.current == nil || q.finished {
+		return ""
+	}
+
+	return taskKey(q.current.Name, q.task, q.entry)
+}
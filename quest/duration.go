@@ -0,0 +1,52 @@
+package quest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Duration is a delay in quest and config files. It is either a number
+// of seconds, which is how delays were always written, or a Go duration
+// string like "90s" or "2m30s"
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	var parsed time.Duration
+	switch val := v.(type) {
+	case float64:
+		parsed = time.Duration(val * float64(time.Second))
+	case string:
+		var err error
+		parsed, err = time.ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %s", val, err)
+		}
+	case nil:
+		parsed = 0
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+
+	if parsed < 0 {
+		return errors.New("negative duration " + string(b))
+	}
+
+	*d = Duration(parsed)
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package quest
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDurationFromSeconds(t *testing.T) {
+	var d Duration
+	assert.NoError(t, json.Unmarshal([]byte("5"), &d))
+	assert.Equal(t, 5 * time.Second, d.Duration())
+
+	assert.NoError(t, json.Unmarshal([]byte("1.5"), &d))
+	assert.Equal(t, 1500 * time.Millisecond, d.Duration())
+}
+
+func TestDurationFromString(t *testing.T) {
+	var d Duration
+	assert.NoError(t, json.Unmarshal([]byte(`"2m30s"`), &d))
+	assert.Equal(t, 150 * time.Second, d.Duration())
+
+	assert.NoError(t, json.Unmarshal([]byte(`"90s"`), &d))
+	assert.Equal(t, 90 * time.Second, d.Duration())
+}
+
+func TestInvalidDuration(t *testing.T) {
+	var d Duration
+	assert.Error(t, json.Unmarshal([]byte(`"soon"`), &d))
+	assert.Error(t, json.Unmarshal([]byte(`-1`), &d))
+	assert.Error(t, json.Unmarshal([]byte(`true`), &d))
+}
+
+func TestDurationRoundTrip(t *testing.T) {
+	b, err := json.Marshal(Duration(90 * time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, `"1m30s"`, string(b))
+
+	var d Duration
+	assert.NoError(t, json.Unmarshal(b, &d))
+	assert.Equal(t, 90 * time.Second, d.Duration())
+}
@@ -0,0 +1,156 @@
+package quest
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+func (qd QuestDescriptions) validate() error {
+	if len(qd) == 0 {
+		return errors.New("no missions")
+	}
+
+	idx := make(map[string]int)
+	for i, d := range qd {
+		if d.Name == "" {
+			return fmt.Errorf("mission #%d has no name", i + 1)
+		}
+
+		if _, ok := idx[d.Name]; ok {
+			return fmt.Errorf("duplicate mission %q", d.Name)
+		}
+
+		idx[d.Name] = i
+	}
+
+	for _, d := range qd {
+		if len(d.Tasks) > 0 && !reflect.DeepEqual(d.Task, TaskDescription{}) {
+			return fmt.Errorf("mission %q has both task and tasks", d.Name)
+		}
+
+		for j, td := range d.tasks() {
+			if td.Fuzzy != nil && (td.Fuzzy.Threshold <= 0 || td.Fuzzy.Threshold > 1) {
+				return fmt.Errorf("task #%d of mission %q: fuzzy threshold must be within (0, 1]", j + 1, d.Name)
+			}
+
+			if !td.Clue.Empty() && len(td.Clues) > 0 {
+				return fmt.Errorf("task #%d of mission %q has both clue and clues", j + 1, d.Name)
+			}
+
+			for k, c := range td.Clues {
+				if c.Reveal && k != len(td.Clues) - 1 {
+					return fmt.Errorf("task #%d of mission %q: only the last clue may reveal the answer", j + 1, d.Name)
+				}
+
+				if c.Text.Empty() && !c.Reveal {
+					return fmt.Errorf("task #%d of mission %q: clue #%d has no text", j + 1, d.Name, k + 1)
+				}
+			}
+
+			if l := td.Location; l != nil && (l.Radius <= 0 || l.Latitude < -90 || l.Latitude > 90 || l.Longitude < -180 || l.Longitude > 180) {
+				return fmt.Errorf("task #%d of mission %q: location must be on the map and have a positive radius", j + 1, d.Name)
+			}
+
+			if err := td.validateChoices(); err != nil {
+				return fmt.Errorf("task #%d of mission %q: %s", j + 1, d.Name, err)
+			}
+		}
+
+		if d.Final && d.Next != "" {
+			return fmt.Errorf("mission %q is final but has next mission %q", d.Name, d.Next)
+		}
+
+		if d.Next != "" {
+			if _, ok := idx[d.Next]; !ok {
+				return fmt.Errorf("mission %q links to unknown mission %q", d.Name, d.Next)
+			}
+		}
+
+		for j, b := range d.Branches {
+			if len(b.Answers) == 0 {
+				return fmt.Errorf("branch #%d of mission %q has no answers", j + 1, d.Name)
+			}
+
+			if _, ok := idx[b.Next]; !ok {
+				return fmt.Errorf("branch #%d of mission %q links to unknown mission %q", j + 1, d.Name, b.Next)
+			}
+		}
+	}
+
+	reachable := qd.reachable()
+	for _, d := range qd {
+		if !reachable[d.Name] {
+			return fmt.Errorf("mission %q is unreachable", d.Name)
+		}
+	}
+
+	return nil
+}
+
+func (td TaskDescription) validateChoices() error {
+	if len(td.Choices) == 0 {
+		return nil
+	}
+
+	if td.Statement.Empty() {
+		return errors.New("choices must have a statement to be shown with")
+	}
+
+	seen := make(map[string]bool)
+	correct := false
+	for k, c := range td.Choices {
+		if c.Text == "" {
+			return fmt.Errorf("choice #%d has no text", k + 1)
+		}
+
+		// the text goes into the data of the button, which Telegram limits in bytes
+		if len(c.Text) > maxChoice {
+			return fmt.Errorf("choice %q is longer than %d bytes", c.Text, maxChoice)
+		}
+
+		if seen[c.Text] {
+			return fmt.Errorf("duplicate choice %q", c.Text)
+		}
+		seen[c.Text] = true
+
+		correct = correct || c.Correct
+	}
+
+	if !correct {
+		return errors.New("none of the choices is correct")
+	}
+
+	return nil
+}
+
+func (qd QuestDescriptions) reachable() map[string]bool {
+	idx := make(map[string]int)
+	for i, d := range qd {
+		idx[d.Name] = i
+	}
+
+	visited := map[string]bool{qd[0].Name: true}
+	queue := []int{0}
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+
+		var links []string
+		if next := qd.defaultNext(i); next != "" {
+			links = append(links, next)
+		}
+		for _, b := range qd[i].Branches {
+			links = append(links, b.Next)
+		}
+
+		for _, l := range links {
+			if !visited[l] {
+				visited[l] = true
+				queue = append(queue, idx[l])
+			}
+		}
+	}
+
+	return visited
+}
@@ -0,0 +1,33 @@
+package quest
+
+import (
+	"math"
+)
+
+const earthRadius = 6371000
+
+// LocationDescription is the place where the player must be to complete the task,
+// a circle of the radius in meters around the point
+type LocationDescription struct {
+	Latitude float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Radius float64 `json:"radius"`
+}
+
+func (l LocationDescription) contains(latitude, longitude float64) bool {
+	return distance(l.Latitude, l.Longitude, latitude, longitude) <= l.Radius
+}
+
+// distance is the great-circle distance between two points in meters
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	phi1, phi2 := radians(lat1), radians(lat2)
+	dPhi, dLambda := radians(lat2 - lat1), radians(lon2 - lon1)
+
+	a := math.Sin(dPhi / 2) * math.Sin(dPhi / 2) + math.Cos(phi1) * math.Cos(phi2) * math.Sin(dLambda / 2) * math.Sin(dLambda / 2)
+
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
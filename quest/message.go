@@ -0,0 +1,142 @@
+package quest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/merisho/quest/transport"
+	"os"
+	"path/filepath"
+)
+
+// Message is a text of the quest sent to the player. In quest files it is
+// either a string of plain text or an object with the text, its parse mode and media,
+// like {"text": "Find the <b>old bridge</b>", "parseMode": "HTML", "media": {"type": "photo", "file": "bridge.jpg"}}.
+// The text is the caption of the media
+type Message struct {
+	Text string `json:"text"`
+	ParseMode transport.ParseMode `json:"parseMode,omitempty"`
+	Media *transport.Media `json:"media,omitempty"`
+}
+
+func (m Message) Empty() bool {
+	return m.Text == "" && m.Media == nil
+}
+
+func (m Message) Outgoing(kind transport.Kind) transport.Outgoing {
+	return transport.Outgoing{
+		Text: m.Text,
+		ParseMode: m.ParseMode,
+		Media: m.Media,
+		Kind: kind,
+	}
+}
+
+func (m Message) MarshalJSON() ([]byte, error) {
+	if m.ParseMode == transport.PlainText && m.Media == nil {
+		return json.Marshal(m.Text)
+	}
+
+	type message Message
+	return json.Marshal(message(m))
+}
+
+func (m *Message) UnmarshalJSON(b []byte) error {
+	var text string
+	if err := json.Unmarshal(b, &text); err == nil {
+		*m = Message{Text: text}
+		return nil
+	}
+
+	type message Message
+	var parsed message
+	if err := json.Unmarshal(b, &parsed); err != nil {
+		return err
+	}
+
+	*m = Message(parsed)
+
+	return nil
+}
+
+// resolveMedia makes the paths of media files relative to the directory
+// of the quest file and checks that the files exist
+func (m *Message) resolveMedia(dir string) error {
+	if m.Media == nil {
+		return nil
+	}
+
+	switch m.Media.Type {
+	case transport.Location:
+		if m.Media.File != "" {
+			return errors.New("location must not have a file")
+		}
+
+		if m.Media.Latitude < -90 || m.Media.Latitude > 90 || m.Media.Longitude < -180 || m.Media.Longitude > 180 {
+			return fmt.Errorf("invalid location %g, %g", m.Media.Latitude, m.Media.Longitude)
+		}
+
+		return nil
+	case transport.Photo, transport.Audio, transport.Document:
+	default:
+		return fmt.Errorf("unknown media type %q", m.Media.Type)
+	}
+
+	if m.Media.File == "" {
+		return fmt.Errorf("%s must have a file", m.Media.Type)
+	}
+
+	media := *m.Media
+	if !filepath.IsAbs(media.File) {
+		media.File = filepath.Join(dir, media.File)
+	}
+
+	info, err := os.Stat(media.File)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", media.File)
+	}
+
+	m.Media = &media
+
+	return nil
+}
+
+// messages are all the messages of the mission, so they can be changed in place
+func (qd *QuestDescription) messages() []*Message {
+	msgs := []*Message{&qd.MissionStartMessage, &qd.MissionEndMessage}
+	msgs = append(msgs, qd.Task.messages()...)
+	for i := range qd.Tasks {
+		msgs = append(msgs, qd.Tasks[i].messages()...)
+	}
+
+	return msgs
+}
+
+func (td *TaskDescription) messages() []*Message {
+	msgs := []*Message{&td.Statement, &td.Clue}
+	for i := range td.Clues {
+		msgs = append(msgs, &td.Clues[i].Text)
+	}
+
+	if td.Fuzzy != nil {
+		msgs = append(msgs, &td.Fuzzy.Message)
+	}
+
+	return msgs
+}
+
+func (qd QuestDescriptions) resolveMedia(dir string) error {
+	for i := range qd {
+		for _, m := range qd[i].messages() {
+			if err := m.resolveMedia(dir); err != nil {
+				return fmt.Errorf("mission %q: %s", qd[i].Name, err)
+			}
+		}
+	}
+
+	return nil
+}
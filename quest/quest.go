@@ -1,145 +1,606 @@
 package quest
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/merisho/quest/outbox"
+	"github.com/merisho/quest/scheduler"
+	"github.com/merisho/quest/transport"
 	"github.com/merisho/quester"
-	"io"
 	"io/ioutil"
 	"log"
-	"strings"
+	"path/filepath"
 	"time"
 )
 
 type QuestDescriptions []QuestDescription
 
-func (qd QuestDescriptions) buildQuesterMissions(out io.Writer) []quester.Mission {
+func (qd QuestDescriptions) buildQuesterMissions(q *Quest) ([]quester.Mission, error) {
 	var missions []quester.Mission
-	for i := 0; i < len(qd) - 1; i++ {
-		m := qd[i].buildQuesterMission(out)
-		m.Next = qd[i + 1].Name
+	for i, d := range qd {
+		m, err := d.buildQuesterMission(q)
+		if err != nil {
+			return nil, err
+		}
+		m.Next = qd.defaultNext(i)
 
 		missions = append(missions, m)
 	}
 
-	return append(missions, qd[len(qd) - 1].buildQuesterMission(out))
+	return missions, nil
+}
+
+// defaultNext is the mission which follows a correct answer
+// that is not bound to any branch
+func (qd QuestDescriptions) defaultNext(i int) string {
+	d := qd[i]
+	if d.Final {
+		return ""
+	}
+
+	if d.Next != "" {
+		return d.Next
+	}
+
+	if i == len(qd) - 1 {
+		return ""
+	}
+
+	return qd[i + 1].Name
 }
 
 type QuestDescription struct {
 	Name string `json:"name"`
-	MissionStartMessage string `json:"missionStartMessage"`
-	MissionStartDelay time.Duration `json:"missionStartDelay"`
-	MissionEndMessage   string `json:"missionEndMessage"`
+	MissionStartMessage Message `json:"missionStartMessage"`
+	MissionStartDelay Duration `json:"missionStartDelay"`
+	MissionEndMessage Message `json:"missionEndMessage"`
 	Task TaskDescription `json:"task"`
+	Tasks []TaskDescription `json:"tasks"`
+	Next string `json:"next"`
+	Final bool `json:"final"`
+	Branches []BranchDescription `json:"branches"`
+}
+
+type BranchDescription struct {
+	Answers []string `json:"answers"`
+	Next string `json:"next"`
+}
+
+func (qd QuestDescription) tasks() []TaskDescription {
+	if len(qd.Tasks) > 0 {
+		return qd.Tasks
+	}
+
+	return []TaskDescription{qd.Task}
 }
 
-func (qd QuestDescription) buildQuesterMission(out io.Writer) quester.Mission {
+func (qd QuestDescription) buildQuesterMission(q *Quest) (quester.Mission, error) {
+	tasks := qd.tasks()
+
+	var qTasks quester.Tasks
+	for i, td := range tasks {
+		matcher, err := newAnswerMatcher(td)
+		if err != nil {
+			return quester.Mission{}, fmt.Errorf("task #%d of mission %q: %s", i + 1, qd.Name, err)
+		}
+
+		last := i == len(tasks) - 1
+
+		var clue string
+		if clues := td.clues(); len(clues) > 0 {
+			clue = clues[0].Text.Text
+		}
+
+		qTasks = append(qTasks, &quester.Task{
+			Statement: td.Statement.Text,
+			Clue: clue,
+			Resolve: func(answer string) bool {
+				if q.location != nil {
+					return td.Location != nil && td.Location.contains(q.location.Latitude, q.location.Longitude)
+				}
+
+				if last {
+					for _, b := range qd.Branches {
+						if matcher.oneOf(answer, b.Answers) {
+							q.next = b.Next
+							return true
+						}
+					}
+				}
+
+				if matcher.match(answer) {
+					return true
+				}
+
+				if td.Fuzzy == nil {
+					return false
+				}
+
+				best, next := matcher.similarity(answer, td.answers()), ""
+				if last {
+					for _, b := range qd.Branches {
+						if s := matcher.similarity(answer, b.Answers); s > best {
+							best, next = s, b.Next
+						}
+					}
+				}
+
+				if best < td.Fuzzy.Threshold {
+					return false
+				}
+
+				if !td.Fuzzy.Accept {
+					q.result = CloseAnswer
+					return false
+				}
+
+				if next != "" {
+					q.next = next
+				}
+				q.result = AcceptedCloseAnswer
+
+				return true
+			},
+		})
+	}
+
 	return quester.Mission{
 		Name: qd.Name,
-		Tasks: quester.Tasks{
-			{
-				Statement: qd.Task.Statement,
-				Clue: qd.Task.Clue,
-				Resolve: func(answer string) bool {
-					return strings.ToLower(answer) == qd.Task.CorrectAnswer
-				},
-			},
-		},
+		Tasks: qTasks,
 		Start: func() {
-			if qd.MissionStartMessage != "" {
-				time.Sleep(qd.MissionStartDelay * time.Second)
-				if _, err := out.Write([]byte(qd.MissionStartMessage)); err != nil {
-					log.Println(err)
-				}
+			if q.resuming {
+				q.sayStatement(0, tasks[q.task])
+				return
 			}
 
-			time.Sleep(qd.Task.StatementDelay * time.Second)
-
-			if _, err := out.Write([]byte(qd.Task.Statement)); err != nil {
-				log.Println(err)
+			if !qd.MissionStartMessage.Empty() {
+				q.say(qd.MissionStartDelay.Duration(), qd.MissionStartMessage, transport.StoryMessage)
 			}
+
+			q.startTask(tasks[0])
 		},
 		End: func() {
-			if qd.MissionEndMessage == "" {
+			if qd.MissionEndMessage.Empty() {
 				return
 			}
 
-			_, err := out.Write([]byte(qd.MissionEndMessage))
-			if err != nil {
-				log.Println(err)
-			}
+			q.say(0, qd.MissionEndMessage, transport.StoryMessage)
 		},
-	}
+	}, nil
 }
 
 type TaskDescription struct {
-	Statement string `json:"statement"`
-	StatementDelay time.Duration `json:"statementDelay"`
-	Clue string `json:"clue"`
+	Statement Message `json:"statement"`
+	StatementDelay Duration `json:"statementDelay"`
+	Clue Message `json:"clue"`
+	Clues []ClueDescription `json:"clues"`
 	CorrectAnswer string `json:"correctAnswer"`
+	CorrectAnswers []string `json:"correctAnswers"`
+	// AnswerPatterns are regular expressions matched against the normalized answer
+	AnswerPatterns []string `json:"answerPatterns"`
+	Normalize []string `json:"normalize"`
+	Fuzzy *FuzzyDescription `json:"fuzzy"`
+	Choices []ChoiceDescription `json:"choices"`
+	Location *LocationDescription `json:"location"`
+}
+
+// ChoiceDescription is an option of a multiple-choice task. The options are shown
+// as buttons under the statement, pressing one answers the task with its text
+type ChoiceDescription struct {
+	Text string `json:"text"`
+	Correct bool `json:"correct"`
+}
+
+// FuzzyDescription configures near-miss detection of a task. Threshold is the
+// similarity of the answer to an accepted one, from 0 to 1, which makes the answer close.
+// Close answers are accepted if Accept is set, otherwise Message is sent to the player
+type FuzzyDescription struct {
+	Threshold float64 `json:"threshold"`
+	Accept bool `json:"accept"`
+	Message Message `json:"message"`
+}
+
+// ClueDescription is a tier of clues. The tier is unlocked after the given number
+// of wrong answers or the given time spent on the task, whichever comes first.
+// The time is a Duration, a number of seconds or a string like "10m".
+// If neither is set, the player's default number of wrong answers is used.
+// Reveal marks the final tier which discloses the answer
+type ClueDescription struct {
+	Text Message `json:"text"`
+	AfterWrongAnswers int `json:"afterWrongAnswers"`
+	AfterTime Duration `json:"afterTime"`
+	Reveal bool `json:"reveal"`
+}
+
+func (td TaskDescription) clues() []ClueDescription {
+	if len(td.Clues) == 0 {
+		if td.Clue.Empty() {
+			return nil
+		}
+
+		return []ClueDescription{{Text: td.Clue}}
+	}
+
+	clues := make([]ClueDescription, len(td.Clues))
+	copy(clues, td.Clues)
+
+	last := &clues[len(clues) - 1]
+	if last.Reveal && last.Text.Empty() {
+		if answers := td.answers(); len(answers) > 0 {
+			last.Text = Message{Text: answers[0]}
+		} else if td.Location != nil {
+			last.Text = Message{Media: &transport.Media{
+				Type: transport.Location,
+				Latitude: td.Location.Latitude,
+				Longitude: td.Location.Longitude,
+			}}
+		}
+	}
+
+	return clues
 }
 
-func NewQuestFromFile(path string, out io.Writer) (*Quest, error) {
+func (td TaskDescription) answers() []string {
+	var answers []string
+	if td.CorrectAnswer != "" {
+		answers = append(answers, td.CorrectAnswer)
+	}
+
+	for _, a := range td.CorrectAnswers {
+		if a != "" {
+			answers = append(answers, a)
+		}
+	}
+
+	for _, c := range td.Choices {
+		if c.Correct {
+			answers = append(answers, c.Text)
+		}
+	}
+
+	return answers
+}
+
+// statement is the statement of the task with the buttons of its choices, one per row.
+// The buttons carry the key of the task along with the choice
+func (td TaskDescription) statement(key string) transport.Outgoing {
+	msg := td.Statement.Outgoing(transport.StatementMessage)
+	for _, c := range td.Choices {
+		msg.Keyboard = append(msg.Keyboard, []transport.Button{{Text: c.Text, Data: choiceData(key, c.Text)}})
+	}
+
+	return msg
+}
+
+// Options are the settings of the quest as a whole
+type Options struct {
+	// SplitLongMessages is the coarsest boundary the messages
+	// longer than Telegram accepts are split on
+	SplitLongMessages outbox.SplitMode `json:"splitLongMessages"`
+}
+
+// questFile is the list of the missions, or an object with the missions and the options
+type questFile struct {
+	Options
+	Missions QuestDescriptions `json:"missions"`
+}
+
+func (f *questFile) UnmarshalJSON(b []byte) error {
+	if b = bytes.TrimSpace(b); len(b) > 0 && b[0] == '[' {
+		return json.Unmarshal(b, &f.Missions)
+	}
+
+	type object questFile
+	return json.Unmarshal(b, (*object)(f))
+}
+
+func readQuestFile(path string) (questFile, error) {
+	var f questFile
+
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, err
+		return f, err
+	}
+
+	if err = json.Unmarshal(b, &f); err != nil {
+		return f, errors.New("invalid JSON: " + err.Error())
 	}
 
-	var descr QuestDescriptions
-	err = json.Unmarshal(b, &descr)
+	return f, nil
+}
+
+// LoadOptions reads the options of the quest file, they are empty if the file has only the missions
+func LoadOptions(path string) (Options, error) {
+	f, err := readQuestFile(path)
+	return f.Options, err
+}
+
+func NewQuestFromFile(path string, out transport.Output) (*Quest, error) {
+	f, err := readQuestFile(path)
 	if err != nil {
-		return nil, errors.New("invalid JSON: " + err.Error())
+		return nil, err
+	}
+
+	descr := f.Missions
+	if err = descr.validate(); err != nil {
+		return nil, errors.New("invalid quest: " + err.Error())
 	}
 
-	q := constructQuest(descr, out)
+	if err = descr.resolveMedia(filepath.Dir(path)); err != nil {
+		return nil, errors.New("invalid quest: " + err.Error())
+	}
+
+	q, err := constructQuest(descr, out)
+	if err != nil {
+		return nil, errors.New("invalid quest: " + err.Error())
+	}
 
 	return q, nil
 }
 
-func constructQuest(descr QuestDescriptions, out io.Writer) *Quest {
+func constructQuest(descr QuestDescriptions, out transport.Output) (*Quest, error) {
 	q := &Quest{
-		qst: quester.NewQuest(),
 		out: out,
+		sched: scheduler.NewScheduler(scheduler.RealClock),
+		missions: make(map[string]quester.Mission),
+		tasks: make(map[string][]TaskDescription),
+		first: descr[0].Name,
+	}
+
+	for _, d := range descr {
+		q.tasks[d.Name] = d.tasks()
+	}
+
+	missions, err := descr.buildQuesterMissions(q)
+	if err != nil {
+		return nil, err
 	}
 
-	missions := descr.buildQuesterMissions(out)
 	for _, m := range missions {
-		q.qst.AddMission(m)
+		q.missions[m.Name] = m
 	}
 
-	return q
+	return q, nil
 }
 
+type AnswerResult int
+
+const (
+	WrongAnswer AnswerResult = iota
+	CorrectAnswer
+	// CloseAnswer is a wrong answer which is very close to an accepted one
+	CloseAnswer
+	// AcceptedCloseAnswer is a close answer accepted as the correct one
+	AcceptedCloseAnswer
+)
+
+func (r AnswerResult) Correct() bool {
+	return r == CorrectAnswer || r == AcceptedCloseAnswer
+}
+
+// Quest walks the graph of missions. quester.Mission keeps the state of tasks
+// within a mission, while transitions between missions are done here
+// since the next mission may depend on the given answer
 type Quest struct {
-	out io.Writer
-	qst *quester.Quest
+	out transport.Output
+	sched *scheduler.Scheduler
+	missions map[string]quester.Mission
+	tasks map[string][]TaskDescription
+	first string
+	current *quester.Mission
+	task int
+	next string
+	result AnswerResult
+	// location is the location being answered, if any
+	location *transport.Point
+	// entry counts the missions entered, a resumed quest continues the count
+	entry int
+	started bool
+	finished bool
+	resuming bool
+}
+
+// UseScheduler makes the quest send its delayed messages through the given scheduler,
+// so they can be ordered with other messages of the player and cancelled
+func (q *Quest) UseScheduler(s *scheduler.Scheduler) {
+	q.sched = s
 }
 
 func (q *Quest) MissionCount() int {
-	return q.qst.Length()
+	return len(q.missions)
 }
 
 func (q *Quest) Start() {
-	q.qst.Start()
+	if q.started {
+		return
+	}
+
+	q.started = true
+	q.enter(q.first)
+}
+
+// Resume starts the quest from the given task of the mission. Unlike Start it skips
+// start messages and delays and only repeats the statement of the task
+func (q *Quest) Resume(missionName string, task int) error {
+	return q.ResumeEntry(missionName, task, 0)
+}
+
+// ResumeEntry is Resume of the entry of the mission the quest was saved at,
+// so the buttons sent before are still of the current task
+func (q *Quest) ResumeEntry(missionName string, task, entry int) error {
+	if _, ok := q.missions[missionName]; !ok {
+		return errors.New("unknown mission: " + missionName)
+	}
+
+	if task < 0 || task >= len(q.tasks[missionName]) {
+		return fmt.Errorf("mission %q has no task #%d", missionName, task + 1)
+	}
+
+	q.started = true
+	q.finished = false
+
+	q.resuming = true
+	defer func() {
+		q.resuming = false
+	}()
+
+	q.entry = entry
+	q.enterAt(missionName, task)
+
+	return nil
 }
 
 func (q *Quest) MissionName() string {
-	return q.qst.Current().Name
+	if q.current == nil || q.finished {
+		return ""
+	}
+
+	return q.current.Name
+}
+
+// Entry is the number of the missions entered up to the current one, it is saved to resume the quest
+func (q *Quest) Entry() int {
+	return q.entry
+}
+
+// TaskIndex is the zero-based index of the current task within the current mission
+func (q *Quest) TaskIndex() int {
+	return q.task
 }
 
 func (q *Quest) CompleteMission() {
-	q.qst.PassCurrent()
+	if !q.started || q.finished {
+		return
+	}
+
+	q.pass()
 }
 
-func (q *Quest) Answer(ans string) bool {
-	res, _ := q.qst.ResolveCurrentTask(ans)
+func (q *Quest) Answer(ans string) AnswerResult {
+	if !q.started || q.finished {
+		return WrongAnswer
+	}
+
+	q.result = WrongAnswer
+	if q.current.ResolveCurrentTask(ans) && q.result == WrongAnswer {
+		q.result = CorrectAnswer
+	}
+	res := q.result
+
+	if q.current.IsFinished() {
+		q.pass()
+		return res
+	}
+
+	if res.Correct() {
+		q.task++
+		q.startTask(q.tasks[q.current.Name][q.task])
+	}
+
 	return res
 }
 
+// AnswerLocation answers the current task with the location of the player.
+// Only location tasks may be resolved with it
+func (q *Quest) AnswerLocation(p transport.Point) AnswerResult {
+	q.location = &p
+	defer func() {
+		q.location = nil
+	}()
+
+	return q.Answer("")
+}
+
 func (q *Quest) Finished() bool {
-	return q.qst.IsFinished()
+	return q.finished
+}
+
+// CloseMessage is the reply to a close answer to the current task
+func (q *Quest) CloseMessage() Message {
+	if q.current == nil || q.finished {
+		return Message{}
+	}
+
+	td := q.tasks[q.current.Name][q.task]
+	if td.Fuzzy == nil {
+		return Message{}
+	}
+
+	return td.Fuzzy.Message
+}
+
+// Clues are the tiers of clues of the current task
+func (q *Quest) Clues() []ClueDescription {
+	if q.current == nil || q.finished {
+		return nil
+	}
+
+	return q.tasks[q.current.Name][q.task].clues()
 }
 
 func (q *Quest) Clue() string {
-	return q.qst.Current().Clue()
+	if q.current == nil || q.finished {
+		return ""
+	}
+
+	return q.current.Clue()
+}
+
+func (q *Quest) enter(missionName string) {
+	q.enterAt(missionName, 0)
+}
+
+// enterAt makes a fresh copy of the mission, so the tasks
+// of a mission visited more than once start over
+func (q *Quest) enterAt(missionName string, task int) {
+	m := q.missions[missionName]
+	m.Tasks = m.Tasks[task:]
+	q.current = &m
+	q.task = task
+	if !q.resuming {
+		q.entry++
+	}
+	q.next = m.Next
+
+	if m.Start != nil {
+		m.Start()
+	}
+}
+
+func (q *Quest) pass() {
+	if q.current.End != nil {
+		q.current.End()
+	}
+
+	if q.next == "" {
+		q.finished = true
+		return
+	}
+
+	q.enter(q.next)
+}
+
+func (q *Quest) startTask(td TaskDescription) {
+	q.sayStatement(td.StatementDelay.Duration(), td)
+}
+
+func (q *Quest) sayStatement(delay time.Duration, td TaskDescription) {
+	msg := td.statement(q.TaskKey())
+	q.sched.After(delay, func() {
+		q.write(msg)
+	})
+}
+
+func (q *Quest) say(delay time.Duration, msg Message, kind transport.Kind) {
+	q.sched.After(delay, func() {
+		q.write(msg.Outgoing(kind))
+	})
+}
+
+func (q *Quest) write(msg transport.Outgoing) {
+	if err := q.out.Send(msg); err != nil {
+		log.Println(err)
+	}
 }
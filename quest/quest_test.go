@@ -1,17 +1,30 @@
 package quest
 
 import (
+	"encoding/json"
+	"github.com/merisho/quest/outbox"
+	"github.com/merisho/quest/scheduler"
+	"github.com/merisho/quest/transport"
 	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 type MockOut struct {
 	outs [][]byte
+	modes []transport.ParseMode
+	media []*transport.Media
+	keyboards [][][]transport.Button
 }
 
-func (o *MockOut) Write(b []byte) (int, error) {
-	o.outs = append(o.outs, b)
-	return len(b), nil
+func (o *MockOut) Send(msg transport.Outgoing) error {
+	o.outs = append(o.outs, []byte(msg.Text))
+	o.modes = append(o.modes, msg.ParseMode)
+	o.media = append(o.media, msg.Media)
+	o.keyboards = append(o.keyboards, msg.Keyboard)
+	return nil
 }
 
 func (o *MockOut) Last() string {
@@ -30,6 +43,15 @@ func (o *MockOut) OffsetLast(offset int) string {
 	return string(o.outs[len(o.outs) - 1 - offset])
 }
 
+func (o *MockOut) strings() []string {
+	var strs []string
+	for _, b := range o.outs {
+		strs = append(strs, string(b))
+	}
+
+	return strs
+}
+
 func (o *MockOut) First() string {
 	return string(o.outs[0])
 }
@@ -60,6 +82,20 @@ func TestConstructsMissionsFromJSONFile(t *testing.T) {
 	assert.Equal(t, 2, q.MissionCount())
 }
 
+func TestQuestOptions(t *testing.T) {
+	opts, err := LoadOptions("./options.json")
+	assert.NoError(t, err)
+	assert.Equal(t, outbox.SplitSentences, opts.SplitLongMessages)
+
+	q, err := NewQuestFromFile("./options.json", &MockOut{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, q.MissionCount())
+
+	opts, err = LoadOptions("./quest.json")
+	assert.NoError(t, err)
+	assert.Equal(t, Options{}, opts, "a list of missions has no options")
+}
+
 func TestCorrectMissionsLinking(t *testing.T) {
 	defer func() {
 		if e := recover(); e != nil {
@@ -108,7 +144,478 @@ func TestAnswer(t *testing.T) {
 
 	q.Start()
 
-	assert.False(t, q.Answer("3"))
-	assert.True(t, q.Answer("Four"))
+	assert.Equal(t, WrongAnswer, q.Answer("3"))
+	assert.Equal(t, CorrectAnswer, q.Answer("Four"))
+	assert.Equal(t, "Mission 2", q.MissionName())
+}
+
+func TestResume(t *testing.T) {
+	out := &MockOut{}
+	q, _ := NewQuestFromFile("./quest.json", out)
+
+	err := q.Resume("Mission 2", 0)
+	assert.NoError(t, err)
+
 	assert.Equal(t, "Mission 2", q.MissionName())
+	assert.Equal(t, 1, len(out.outs), "must only repeat the statement")
+	assert.Equal(t, "4 + 4", out.Last())
+
+	q.Answer("eight")
+	assert.True(t, q.Finished())
+}
+
+func TestResumeUnknownMission(t *testing.T) {
+	q, _ := NewQuestFromFile("./quest.json", &MockOut{})
+
+	assert.Error(t, q.Resume("Mission 42", 0))
+}
+
+func TestBranchByAnswer(t *testing.T) {
+	out := &MockOut{}
+	q, err := NewQuestFromFile("./branching.json", out)
+	assert.NoError(t, err)
+
+	q.Start()
+	assert.Equal(t, "left or right?", out.Last())
+
+	assert.Equal(t, WrongAnswer, q.Answer("up"))
+	assert.Equal(t, "Crossroads", q.MissionName())
+
+	assert.Equal(t, CorrectAnswer, q.Answer("West"))
+	assert.Equal(t, "Forest", q.MissionName())
+	assert.Equal(t, "forest riddle", out.Last())
+
+	q.Answer("tree")
+	assert.Equal(t, "Castle", q.MissionName(), "must follow explicit next mission")
+
+	q.Answer("king")
+	assert.True(t, q.Finished())
+}
+
+func TestFinalMission(t *testing.T) {
+	q, _ := NewQuestFromFile("./branching.json", &MockOut{})
+
+	q.Start()
+	q.Answer("right")
+	assert.Equal(t, "River", q.MissionName())
+
+	q.Answer("fish")
+	assert.True(t, q.Finished(), "final mission must finish the quest")
+}
+
+func TestInvalidMissionGraph(t *testing.T) {
+	cases := map[string]QuestDescriptions{
+		"no missions": {},
+		"no name": {
+			{Task: TaskDescription{CorrectAnswer: "a"}},
+		},
+		"duplicate": {
+			{Name: "m1"},
+			{Name: "m1"},
+		},
+		"unknown next": {
+			{Name: "m1", Next: "m3"},
+			{Name: "m2"},
+		},
+		"unknown branch": {
+			{Name: "m1", Branches: []BranchDescription{{Answers: []string{"a"}, Next: "m3"}}},
+			{Name: "m2"},
+		},
+		"branch without answers": {
+			{Name: "m1", Branches: []BranchDescription{{Next: "m2"}}},
+			{Name: "m2"},
+		},
+		"final with next": {
+			{Name: "m1", Final: true, Next: "m2"},
+			{Name: "m2"},
+		},
+		"unreachable": {
+			{Name: "m1", Final: true},
+			{Name: "m2"},
+		},
+	}
+
+	for name, descr := range cases {
+		assert.Error(t, descr.validate(), name)
+	}
+}
+
+func TestMultipleTasks(t *testing.T) {
+	out := &MockOut{}
+	q, err := NewQuestFromFile("./tasks.json", out)
+	assert.NoError(t, err)
+
+	q.Start()
+	assert.Equal(t, "Welcome to Mission 1", out.First())
+	assert.Equal(t, "task 1.1", out.Last())
+	assert.Equal(t, "clue 1.1", q.Clue())
+
+	assert.Equal(t, WrongAnswer, q.Answer("answer 1.2"), "tasks must be solved in order")
+
+	assert.Equal(t, CorrectAnswer, q.Answer("answer 1.1"))
+	assert.Equal(t, "Mission 1", q.MissionName())
+	assert.Equal(t, 1, q.TaskIndex())
+	assert.Equal(t, "task 1.2", out.Last())
+	assert.Equal(t, "clue 1.2", q.Clue())
+
+	assert.Equal(t, CorrectAnswer, q.Answer("answer 1.2"))
+	assert.Equal(t, "Mission 1 completed", out.OffsetLast(1), "end message must follow the last task only")
+	assert.Equal(t, "task 2", out.Last())
+	assert.Equal(t, "Mission 2", q.MissionName())
+	assert.Equal(t, 0, q.TaskIndex())
+}
+
+func TestResumeTask(t *testing.T) {
+	out := &MockOut{}
+	q, _ := NewQuestFromFile("./tasks.json", out)
+
+	assert.NoError(t, q.Resume("Mission 1", 1))
+	assert.Equal(t, "task 1.2", out.Last())
+	assert.Equal(t, 1, q.TaskIndex())
+
+	q.Answer("answer 1.2")
+	assert.Equal(t, "Mission 2", q.MissionName())
+
+	assert.Error(t, q.Resume("Mission 1", 2))
+}
+
+func TestTaskAndTasksTogether(t *testing.T) {
+	descr := QuestDescriptions{
+		{
+			Name: "m1",
+			Task: TaskDescription{Statement: Message{Text: "s"}},
+			Tasks: []TaskDescription{{Statement: Message{Text: "s"}}},
+		},
+	}
+
+	assert.Error(t, descr.validate())
+}
+
+func TestCloseAnswer(t *testing.T) {
+	out := &MockOut{}
+	q, err := NewQuestFromFile("./fuzzy.json", out)
+	assert.NoError(t, err)
+
+	q.Start()
+
+	assert.Equal(t, CloseAnswer, q.Answer("filadelphia"))
+	assert.Equal(t, "You are very close", q.CloseMessage().Text)
+	assert.Equal(t, "Mission 1", q.MissionName())
+
+	assert.Equal(t, WrongAnswer, q.Answer("new york"))
+
+	assert.Equal(t, CorrectAnswer, q.Answer("philadelphia"))
+	assert.Equal(t, "Mission 2", q.MissionName())
+}
+
+func TestAcceptedCloseAnswer(t *testing.T) {
+	q, _ := NewQuestFromFile("./fuzzy.json", &MockOut{})
+
+	q.Start()
+	q.Answer("philadelphia")
+
+	assert.Equal(t, AcceptedCloseAnswer, q.Answer("pensylvania"))
+	assert.True(t, q.Finished())
+}
+
+func TestEditDistance(t *testing.T) {
+	assert.Equal(t, 0, editDistance("ёлка", "ёлка"))
+	assert.Equal(t, 1, editDistance("ёлка", "елка"))
+	assert.Equal(t, 3, editDistance("kitten", "sitting"))
+	assert.Equal(t, 4, editDistance("", "test"))
+}
+
+func TestClueTiers(t *testing.T) {
+	q, err := NewQuestFromFile("./clues.json", &MockOut{})
+	assert.NoError(t, err)
+
+	q.Start()
+
+	clues := q.Clues()
+	assert.Equal(t, 3, len(clues))
+	assert.Equal(t, "it is even", q.Clue())
+	assert.Equal(t, 1, clues[0].AfterWrongAnswers)
+	assert.Equal(t, 5 * time.Minute, clues[1].AfterTime.Duration())
+	assert.True(t, clues[2].Reveal)
+	assert.Equal(t, "four", clues[2].Text.Text, "reveal tier without text must disclose the answer")
+}
+
+func TestLegacyClue(t *testing.T) {
+	q, _ := NewQuestFromFile("./quest.json", &MockOut{})
+
+	q.Start()
+
+	assert.Equal(t, []ClueDescription{{Text: Message{Text: "two plus two"}}}, q.Clues())
+}
+
+func TestInvalidClues(t *testing.T) {
+	descr := QuestDescriptions{
+		{
+			Name: "m1",
+			Task: TaskDescription{
+				Clues: []ClueDescription{{Reveal: true}, {Text: Message{Text: "clue"}}},
+			},
+		},
+	}
+	assert.Error(t, descr.validate(), "reveal must be the last tier")
+
+	descr[0].Task.Clues = []ClueDescription{{}}
+	assert.Error(t, descr.validate(), "clue must have text")
+
+	descr[0].Task.Clues = []ClueDescription{{Text: Message{Text: "clue"}}}
+	descr[0].Task.Clue = Message{Text: "clue"}
+	assert.Error(t, descr.validate(), "clue and clues are mutually exclusive")
+}
+
+func TestDelayedMessages(t *testing.T) {
+	out := &MockOut{}
+	q, err := NewQuestFromFile("./delays.json", out)
+	assert.NoError(t, err)
+
+	clock := scheduler.NewFakeClock(time.Now())
+	q.UseScheduler(scheduler.NewScheduler(clock))
+
+	q.Start()
+	assert.Empty(t, out.outs, "Start must not block on delays")
+
+	clock.Advance(2 * time.Second)
+	assert.Equal(t, "Welcome to Mission 1", out.Last())
+
+	clock.Advance(2 * time.Second)
+	assert.Equal(t, "Welcome to Mission 1", out.Last())
+
+	clock.Advance(time.Second)
+	assert.Equal(t, "2 + 2", out.Last())
+
+	q.Answer("four")
+	assert.Equal(t, "Mission 1 completed", out.Last())
+
+	clock.Advance(2 * time.Second)
+	assert.Equal(t, "Welcome to Mission 2", out.OffsetLast(1))
+	assert.Equal(t, "4 + 4", out.Last())
+}
+
+func TestEndMessageWaitsForDelayedStatement(t *testing.T) {
+	out := &MockOut{}
+	q, _ := NewQuestFromFile("./delays.json", out)
+
+	clock := scheduler.NewFakeClock(time.Now())
+	q.UseScheduler(scheduler.NewScheduler(clock))
+
+	q.Start()
+	q.Answer("four")
+	assert.Empty(t, out.outs)
+
+	clock.Advance(5 * time.Second)
+	assert.Equal(t, []string{"Welcome to Mission 1", "2 + 2", "Mission 1 completed"}, out.strings())
+}
+
+func TestFormattedMessages(t *testing.T) {
+	out := &MockOut{}
+	q, err := NewQuestFromFile("./formatted.json", out)
+	assert.NoError(t, err)
+
+	q.Start()
+	assert.Equal(t, []string{"Welcome to the <b>Bridge</b>", "What is under the *bridge*?"}, out.strings())
+	assert.Equal(t, []transport.ParseMode{transport.HTML, transport.Markdown}, out.modes)
+
+	clues := q.Clues()
+	assert.Equal(t, Message{Text: "||It flows||", ParseMode: transport.MarkdownV2}, clues[0].Text)
+	assert.Equal(t, "||It flows||", q.Clue())
+
+	q.Answer("river")
+	assert.Equal(t, "You crossed the bridge", out.Last())
+	assert.Equal(t, transport.PlainText, out.modes[len(out.modes) - 1])
+}
+
+func TestMessageJSON(t *testing.T) {
+	var m Message
+	assert.NoError(t, json.Unmarshal([]byte(`"plain"`), &m))
+	assert.Equal(t, Message{Text: "plain"}, m)
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"text": "<i>x</i>", "parseMode": "HTML"}`), &m))
+	assert.Equal(t, Message{Text: "<i>x</i>", ParseMode: transport.HTML}, m)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"text": "x", "parseMode": "BBCode"}`), &m))
+
+	b, err := json.Marshal(Message{Text: "plain"})
+	assert.NoError(t, err)
+	assert.Equal(t, `"plain"`, string(b))
+
+	b, err = json.Marshal(Message{Text: "<i>x</i>", ParseMode: transport.HTML})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"text": "<i>x</i>", "parseMode": "HTML"}`, string(b))
+}
+
+func TestMedia(t *testing.T) {
+	out := &MockOut{}
+	q, err := NewQuestFromFile("./media.json", out)
+	assert.NoError(t, err)
+
+	q.Start()
+	assert.Equal(t, []string{"", "What is under the bridge?"}, out.strings())
+	assert.Equal(t, []*transport.Media{
+		{Type: transport.Photo, File: filepath.Join("media", "bridge.jpg")},
+		{Type: transport.Audio, File: filepath.Join("media", "riddle.mp3")},
+	}, out.media)
+
+	q.Answer("river")
+	assert.Equal(t, &transport.Media{Type: transport.Location, Latitude: 55.7539, Longitude: 37.6208}, out.media[2])
+	assert.Equal(t, "Meet us here", out.OffsetLast(1))
+	assert.Equal(t, &transport.Media{Type: transport.Document, File: filepath.Join("media", "map.pdf")}, out.media[3])
+}
+
+func TestInvalidMedia(t *testing.T) {
+	descr := QuestDescriptions{
+		{
+			Name: "Mission 1",
+			Task: TaskDescription{
+				Statement: Message{Media: &transport.Media{Type: transport.Photo, File: "no-such-file.jpg"}},
+			},
+		},
+	}
+	assert.Error(t, descr.resolveMedia("./media"), "media file must exist")
+
+	descr[0].Task.Statement.Media = &transport.Media{Type: "video", File: "bridge.jpg"}
+	assert.Error(t, descr.resolveMedia("./media"), "media type must be known")
+
+	descr[0].Task.Statement.Media = &transport.Media{Type: transport.Photo}
+	assert.Error(t, descr.resolveMedia("./media"), "photo must have a file")
+
+	descr[0].Task.Statement.Media = &transport.Media{Type: transport.Location, Latitude: 91}
+	assert.Error(t, descr.resolveMedia("./media"), "location must be on the map")
+
+	descr[0].Task.Statement.Media = &transport.Media{Type: transport.Photo, File: "bridge.jpg"}
+	assert.NoError(t, descr.resolveMedia("./media"))
+	assert.Equal(t, filepath.Join("media", "bridge.jpg"), descr[0].Task.Statement.Media.File)
+}
+
+func TestChoices(t *testing.T) {
+	out := &MockOut{}
+	q, err := NewQuestFromFile("./choices.json", out)
+	assert.NoError(t, err)
+
+	q.Start()
+	assert.Equal(t, "What is the capital of France?", out.Last())
+	key := taskKey("Mission 1", 0, 1)
+	assert.Equal(t, key, q.TaskKey())
+	assert.Equal(t, [][]transport.Button{
+		{{Text: "London", Data: key + ":London"}},
+		{{Text: "Paris", Data: key + ":Paris"}},
+		{{Text: "Berlin", Data: key + ":Berlin"}},
+	}, out.keyboards[0])
+
+	assert.Equal(t, WrongAnswer, q.Answer("London"))
+	assert.Equal(t, CorrectAnswer, q.Answer("Paris"))
+	assert.Equal(t, 3, len(out.keyboards[1]))
+	assert.NotEqual(t, key, q.TaskKey(), "every task must have a key of its own")
+
+	assert.Equal(t, CorrectAnswer, q.Answer("7"), "any of the correct choices must be accepted")
+	assert.True(t, q.Finished())
+}
+
+func TestTaskKeyOfMissionEnteredAgain(t *testing.T) {
+	q, err := NewQuestFromFile("./choices-loop.json", &MockOut{})
+	assert.NoError(t, err)
+
+	q.Start()
+	first := q.TaskKey()
+	assert.Equal(t, CorrectAnswer, q.Answer("Forest"))
+	assert.Equal(t, CorrectAnswer, q.Answer("Back"))
+	assert.Equal(t, "Crossroads", q.MissionName())
+	assert.NotEqual(t, first, q.TaskKey(), "the buttons of the first visit must be stale")
+
+	resumed, _ := NewQuestFromFile("./choices-loop.json", &MockOut{})
+	assert.NoError(t, resumed.ResumeEntry("Crossroads", 0, q.Entry()))
+	assert.Equal(t, q.TaskKey(), resumed.TaskKey(), "the buttons sent before the restart must not be stale")
+}
+
+func TestParseChoice(t *testing.T) {
+	key := taskKey("Mission 1", 0, 1)
+
+	task, choice := ParseChoice(choiceData(key, "Yes: of course"))
+	assert.Equal(t, key, task)
+	assert.Equal(t, "Yes: of course", choice)
+
+	task, choice = ParseChoice("yes")
+	assert.Equal(t, "", task, "buttons pressed in the console have no key")
+	assert.Equal(t, "yes", choice)
+
+	task, choice = ParseChoice("Note: yes")
+	assert.Equal(t, "", task)
+	assert.Equal(t, "Note: yes", choice)
+}
+
+func TestInvalidChoices(t *testing.T) {
+	descr := QuestDescriptions{
+		{
+			Name: "m1",
+			Task: TaskDescription{
+				Statement: Message{Text: "s"},
+				Choices: []ChoiceDescription{{Text: "a"}, {Text: "b"}},
+			},
+		},
+	}
+	assert.Error(t, descr.validate(), "one of the choices must be correct")
+
+	descr[0].Task.Choices = []ChoiceDescription{{Text: "a", Correct: true}, {Text: "a"}}
+	assert.Error(t, descr.validate(), "choices must be unique")
+
+	descr[0].Task.Choices = []ChoiceDescription{{Text: "", Correct: true}}
+	assert.Error(t, descr.validate(), "choice must have text")
+
+	descr[0].Task.Choices = []ChoiceDescription{{Text: strings.Repeat("я", 28), Correct: true}}
+	assert.Error(t, descr.validate(), "choice must fit into the data of the button")
+
+	descr[0].Task.Choices = []ChoiceDescription{{Text: strings.Repeat("я", 27), Correct: true}}
+	assert.NoError(t, descr.validate(), "choice must fit along with the key of the task")
+
+	descr[0].Task.Choices = []ChoiceDescription{{Text: "a", Correct: true}}
+	descr[0].Task.Statement = Message{}
+	assert.Error(t, descr.validate(), "choices must have a statement")
+
+	descr[0].Task.Statement = Message{Text: "s"}
+	assert.NoError(t, descr.validate())
+}
+
+func TestDistance(t *testing.T) {
+	assert.Equal(t, 0.0, distance(55.7539, 37.6208, 55.7539, 37.6208))
+	assert.InDelta(t, 111195, distance(0, 0, 1, 0), 1, "a degree of latitude")
+	assert.InDelta(t, 2486000, distance(55.7558, 37.6173, 48.8566, 2.3522), 5000, "Moscow to Paris")
+}
+
+func TestLocationTask(t *testing.T) {
+	out := &MockOut{}
+	q, err := NewQuestFromFile("./location.json", out)
+	assert.NoError(t, err)
+
+	q.Start()
+
+	assert.Equal(t, WrongAnswer, q.AnswerLocation(transport.Point{Latitude: 55.7520, Longitude: 37.6175}), "300 m away")
+	assert.Equal(t, WrongAnswer, q.Answer("55.7539, 37.6208"), "location task is not answered with text")
+	assert.Equal(t, &transport.Media{Type: transport.Location, Latitude: 55.7539, Longitude: 37.6208}, q.Clues()[1].Text.Media, "reveal must show the place")
+
+	assert.Equal(t, CorrectAnswer, q.AnswerLocation(transport.Point{Latitude: 55.7545, Longitude: 37.6210}), "70 m away")
+	assert.Equal(t, "Mission 2", q.MissionName())
+
+	assert.Equal(t, WrongAnswer, q.AnswerLocation(transport.Point{Latitude: 55.7525, Longitude: 37.6231}), "text task is not answered with location")
+	assert.Equal(t, CorrectAnswer, q.Answer("saint basil's"))
+}
+
+func TestInvalidLocation(t *testing.T) {
+	descr := QuestDescriptions{
+		{
+			Name: "m1",
+			Task: TaskDescription{
+				Location: &LocationDescription{Latitude: 55.7539, Longitude: 37.6208},
+			},
+		},
+	}
+	assert.Error(t, descr.validate(), "radius must be positive")
+
+	descr[0].Task.Location = &LocationDescription{Latitude: 155.7539, Longitude: 37.6208, Radius: 100}
+	assert.Error(t, descr.validate(), "location must be on the map")
+
+	descr[0].Task.Location = &LocationDescription{Latitude: 55.7539, Longitude: 37.6208, Radius: 100}
+	assert.NoError(t, descr.validate())
 }
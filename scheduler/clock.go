@@ -0,0 +1,135 @@
+package scheduler
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type Timer interface {
+	Stop() bool
+}
+
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// FakeClock moves only when Advance is called. Timers which become due
+// fire synchronously within Advance in the order of their deadlines
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		now: now,
+	}
+}
+
+type FakeClock struct {
+	mu sync.Mutex
+	now time.Time
+	timers []*fakeTimer
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{
+		clock: c,
+		at: c.now.Add(d),
+		f: f,
+	}
+	c.timers = append(c.timers, t)
+
+	return t
+}
+
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		t := c.nextDue(target)
+		if t == nil {
+			break
+		}
+
+		t.f()
+	}
+
+	c.mu.Lock()
+	c.now = target
+	c.mu.Unlock()
+}
+
+// Pending is the number of timers which have not fired or been stopped yet
+func (c *FakeClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.timers)
+}
+
+func (c *FakeClock) nextDue(target time.Time) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sort.SliceStable(c.timers, func(i, j int) bool {
+		return c.timers[i].at.Before(c.timers[j].at)
+	})
+
+	if len(c.timers) == 0 || c.timers[0].at.After(target) {
+		return nil
+	}
+
+	t := c.timers[0]
+	c.timers = c.timers[1:]
+	if t.at.After(c.now) {
+		c.now = t.at
+	}
+
+	return t
+}
+
+func (c *FakeClock) remove(t *fakeTimer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, ct := range c.timers {
+		if ct == t {
+			c.timers = append(c.timers[:i], c.timers[i + 1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	at time.Time
+	f func()
+}
+
+func (t *fakeTimer) Stop() bool {
+	return t.clock.remove(t)
+}
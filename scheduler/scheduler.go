@@ -0,0 +1,108 @@
+package scheduler
+
+import (
+	"sync"
+	"time"
+)
+
+// Scheduler runs jobs one after another. Each job waits for its delay
+// counted from the moment the previous job was done, so the scheduled
+// messages of a player keep their order. A job without delay scheduled
+// on an idle scheduler runs right away in the caller's goroutine
+func NewScheduler(clock Clock) *Scheduler {
+	if clock == nil {
+		clock = RealClock
+	}
+
+	return &Scheduler{
+		clock: clock,
+	}
+}
+
+type Scheduler struct {
+	mu sync.Mutex
+	clock Clock
+	queue []job
+	timer Timer
+	busy bool
+	generation int
+}
+
+type job struct {
+	delay time.Duration
+	f func()
+}
+
+func (s *Scheduler) Clock() Clock {
+	return s.clock
+}
+
+func (s *Scheduler) After(d time.Duration, f func()) {
+	s.mu.Lock()
+	s.queue = append(s.queue, job{d, f})
+	if s.busy {
+		s.mu.Unlock()
+		return
+	}
+
+	s.busy = true
+	gen := s.generation
+	s.mu.Unlock()
+
+	s.run(gen)
+}
+
+// Pending is the number of jobs which have not run yet
+func (s *Scheduler) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.queue)
+}
+
+// Cancel drops all the jobs which have not run yet
+func (s *Scheduler) Cancel() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.generation++
+	s.queue = nil
+	s.busy = false
+
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
+
+func (s *Scheduler) run(gen int) {
+	for {
+		s.mu.Lock()
+		if gen != s.generation {
+			s.mu.Unlock()
+			return
+		}
+
+		if len(s.queue) == 0 {
+			s.busy = false
+			s.timer = nil
+			s.mu.Unlock()
+			return
+		}
+
+		j := s.queue[0]
+		if j.delay > 0 {
+			s.queue[0].delay = 0
+			s.timer = s.clock.AfterFunc(j.delay, func() {
+				s.run(gen)
+			})
+			s.mu.Unlock()
+			return
+		}
+
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		j.f()
+	}
+}
@@ -0,0 +1,92 @@
+package scheduler
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRunsImmediateJobInPlace(t *testing.T) {
+	s := NewScheduler(NewFakeClock(time.Now()))
+
+	done := false
+	s.After(0, func() {
+		done = true
+	})
+
+	assert.True(t, done)
+	assert.Equal(t, 0, s.Pending())
+}
+
+func TestDelaysFollowEachOther(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	s := NewScheduler(clock)
+
+	var got []string
+	s.After(5 * time.Second, func() {
+		got = append(got, "first")
+	})
+	s.After(0, func() {
+		got = append(got, "second")
+	})
+	s.After(3 * time.Second, func() {
+		got = append(got, "third")
+	})
+
+	assert.Empty(t, got, "immediate job must wait for the delayed one scheduled before")
+
+	clock.Advance(5 * time.Second)
+	assert.Equal(t, []string{"first", "second"}, got)
+
+	clock.Advance(2 * time.Second)
+	assert.Equal(t, []string{"first", "second"}, got, "delay must be counted from the previous job")
+
+	clock.Advance(time.Second)
+	assert.Equal(t, []string{"first", "second", "third"}, got)
+	assert.Equal(t, 0, s.Pending())
+
+	s.After(0, func() {
+		got = append(got, "fourth")
+	})
+	assert.Equal(t, "fourth", got[3], "must run in place after the queue is drained")
+}
+
+func TestCancel(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	s := NewScheduler(clock)
+
+	ran := false
+	s.After(time.Second, func() {
+		ran = true
+	})
+	s.After(time.Second, func() {
+		ran = true
+	})
+
+	s.Cancel()
+	clock.Advance(time.Minute)
+
+	assert.False(t, ran)
+	assert.Equal(t, 0, s.Pending())
+	assert.Equal(t, 0, clock.Pending(), "must stop the timer")
+
+	s.After(0, func() {
+		ran = true
+	})
+	assert.True(t, ran, "must be usable after cancel")
+}
+
+func TestRealClock(t *testing.T) {
+	s := NewScheduler(nil)
+
+	done := make(chan struct{})
+	s.After(time.Millisecond, func() {
+		close(done)
+	})
+
+	select {
+	case <- done:
+	case <- time.After(time.Second):
+		assert.Fail(t, "job must run")
+	}
+}
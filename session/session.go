@@ -0,0 +1,139 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"github.com/merisho/quest/player"
+	"github.com/merisho/quest/storage"
+	"github.com/merisho/quest/transport"
+	"strings"
+	"sync"
+)
+
+var SessionNotFoundErr = errors.New("session not found")
+
+// PlayerFactory creates a player for the user. If snap is not nil
+// the player must continue from the snapshot instead of starting over
+type PlayerFactory func(userID string, out transport.Output, snap *storage.Snapshot) (*player.Player, error)
+
+func NewManager(newPlayer PlayerFactory) *Manager {
+	return &Manager{
+		newPlayer: newPlayer,
+		players: make(map[string]*player.Player),
+	}
+}
+
+type Manager struct {
+	mu sync.Mutex
+	newPlayer PlayerFactory
+	players map[string]*player.Player
+}
+
+func (m *Manager) Start(userID string, out transport.Output) (*player.Player, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if p, ok := m.players[userID]; ok {
+		return p, nil
+	}
+
+	return m.create(userID, out, nil)
+}
+
+func (m *Manager) Restart(userID string, out transport.Output) (*player.Player, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.destroy(userID)
+
+	return m.create(userID, out, nil)
+}
+
+// Restore recreates sessions of all unfinished players found in the storage.
+// A session which cannot be restored does not stop the others, the error lists them all
+func (m *Manager) Restore(st storage.Storage, outFor func(userID string) transport.Output) error {
+	snaps, err := st.LoadAll()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var failed []string
+	for i := range snaps {
+		snap := snaps[i]
+		if snap.Finished {
+			continue
+		}
+
+		m.destroy(snap.UserID)
+		if _, err := m.create(snap.UserID, outFor(snap.UserID), &snap); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", snap.UserID, err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d sessions are not restored: %s", len(failed), strings.Join(failed, "; "))
+	}
+
+	return nil
+}
+
+func (m *Manager) Get(userID string) (*player.Player, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.players[userID]
+	return p, ok
+}
+
+func (m *Manager) Count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.players)
+}
+
+func (m *Manager) Destroy(userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.destroy(userID) {
+		return SessionNotFoundErr
+	}
+
+	return nil
+}
+
+func (m *Manager) DestroyAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for userID := range m.players {
+		m.destroy(userID)
+	}
+}
+
+func (m *Manager) create(userID string, out transport.Output, snap *storage.Snapshot) (*player.Player, error) {
+	p, err := m.newPlayer(userID, out, snap)
+	if err != nil {
+		return nil, err
+	}
+
+	m.players[userID] = p
+
+	return p, nil
+}
+
+func (m *Manager) destroy(userID string) bool {
+	p, ok := m.players[userID]
+	if !ok {
+		return false
+	}
+
+	p.Destroy()
+	delete(m.players, userID)
+
+	return true
+}
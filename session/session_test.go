@@ -0,0 +1,200 @@
+package session
+
+import (
+	"bytes"
+	"errors"
+	"github.com/merisho/quest/commandbus"
+	"github.com/merisho/quest/player"
+	"github.com/merisho/quest/quest"
+	"github.com/merisho/quest/storage"
+	"github.com/merisho/quest/transport"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const questFile = "./test-quest.json"
+
+func newFactory(cb *commandbus.CommandBus) PlayerFactory {
+	return func(userID string, out transport.Output, snap *storage.Snapshot) (*player.Player, error) {
+		q, err := quest.NewQuestFromFile(questFile, out)
+		if err != nil {
+			return nil, err
+		}
+
+		conf := player.Config{
+			UserID: userID,
+			WrongAnswersForClue: 3,
+			OutroMessage: "outro message",
+		}
+
+		if snap != nil {
+			return player.RestorePlayer(conf, cb, q, out, *snap)
+		}
+
+		return player.NewPlayer(conf, cb, q, out), nil
+	}
+}
+
+func TestStartCreatesSessionPerUser(t *testing.T) {
+	cb := commandbus.NewCommandBus()
+	m := NewManager(newFactory(cb))
+
+	p1, err := m.Start("user-1", transport.WriterOutput(bytes.NewBuffer(nil)))
+	assert.NoError(t, err)
+	p2, err := m.Start("user-2", transport.WriterOutput(bytes.NewBuffer(nil)))
+	assert.NoError(t, err)
+
+	assert.NotEqual(t, p1, p2)
+	assert.Equal(t, 2, m.Count())
+
+	same, err := m.Start("user-1", transport.WriterOutput(bytes.NewBuffer(nil)))
+	assert.NoError(t, err)
+	assert.Equal(t, p1, same, "must reuse the existing session of the user")
+}
+
+// recorder is the output of a player which the test may read while the player writes to it
+type recorder struct {
+	mu sync.Mutex
+	texts []string
+}
+
+func (r *recorder) Send(msg transport.Outgoing) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.texts = append(r.texts, msg.String())
+	return nil
+}
+
+func (r *recorder) sent(text string) func() bool {
+	return func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		for _, t := range r.texts {
+			if t == text {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+func TestRestartDoesNotAffectOtherUsers(t *testing.T) {
+	cb := commandbus.NewCommandBus()
+	m := NewManager(newFactory(cb))
+
+	out := &recorder{}
+	p1, _ := m.Start("user-1", out)
+	p2, _ := m.Start("user-2", transport.WriterOutput(bytes.NewBuffer(nil)))
+	time.Sleep(10 * time.Millisecond)
+
+	cb.Publish("/a answer 1", "user-1")
+	assert.Eventually(t, out.sent("task 2"), time.Second, time.Millisecond)
+
+	restarted, err := m.Restart("user-2", transport.WriterOutput(bytes.NewBuffer(nil)))
+	assert.NoError(t, err)
+	assert.NotEqual(t, p2, restarted)
+	time.Sleep(10 * time.Millisecond)
+
+	cb.Publish("/a answer 2", "user-1")
+	assert.Eventually(t, out.sent("outro message"), time.Second, time.Millisecond, "restart of another user must not destroy the session")
+
+	cur, _ := m.Get("user-1")
+	assert.Equal(t, p1, cur)
+}
+
+func TestDestroy(t *testing.T) {
+	cb := commandbus.NewCommandBus()
+	m := NewManager(newFactory(cb))
+
+	out := &recorder{}
+	m.Start("user-1", out)
+	m.Start("user-2", transport.WriterOutput(bytes.NewBuffer(nil)))
+	time.Sleep(10 * time.Millisecond)
+
+	assert.NoError(t, m.Destroy("user-1"))
+	assert.Equal(t, SessionNotFoundErr, m.Destroy("user-1"))
+	time.Sleep(10 * time.Millisecond)
+
+	cb.Publish("/a answer 1", "user-1")
+	time.Sleep(10 * time.Millisecond)
+	assert.False(t, out.sent("task 2")(), "destroyed session must NOT handle answers")
+
+	_, ok := m.Get("user-1")
+	assert.False(t, ok)
+
+	m.DestroyAll()
+	assert.Equal(t, 0, m.Count())
+}
+
+func TestFactoryError(t *testing.T) {
+	m := NewManager(func(userID string, out transport.Output, snap *storage.Snapshot) (*player.Player, error) {
+		return nil, errors.New("no quest")
+	})
+
+	p, err := m.Start("user-1", transport.WriterOutput(bytes.NewBuffer(nil)))
+	assert.Error(t, err)
+	assert.Nil(t, p)
+	assert.Equal(t, 0, m.Count())
+}
+
+func TestRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quest-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, _ := storage.NewFileStorage(filepath.Join(dir, "progress.json"))
+	st.Save(storage.Snapshot{UserID: "user-1", Mission: "Mission 2"})
+	st.Save(storage.Snapshot{UserID: "user-2", Finished: true})
+
+	cb := commandbus.NewCommandBus()
+	m := NewManager(newFactory(cb))
+
+	outs := make(map[string]*bytes.Buffer)
+	err = m.Restore(st, func(userID string) transport.Output {
+		outs[userID] = bytes.NewBuffer(nil)
+		return transport.WriterOutput(outs[userID])
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, m.Count(), "must NOT restore finished players")
+
+	_, ok := m.Get("user-1")
+	assert.True(t, ok)
+	assert.Equal(t, "task 2", outs["user-1"].String(), "must continue from the restored mission")
+}
+
+func TestRestoreSkipsBrokenSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quest-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, _ := storage.NewFileStorage(filepath.Join(dir, "progress.json"))
+	st.Save(storage.Snapshot{UserID: "user-1", Mission: "Renamed mission"})
+	st.Save(storage.Snapshot{UserID: "user-2", Mission: "Mission 2"})
+
+	cb := commandbus.NewCommandBus()
+	m := NewManager(newFactory(cb))
+
+	err = m.Restore(st, func(userID string) transport.Output {
+		return transport.WriterOutput(bytes.NewBuffer(nil))
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "user-1")
+
+	_, ok := m.Get("user-1")
+	assert.False(t, ok)
+	_, ok = m.Get("user-2")
+	assert.True(t, ok, "must restore the sessions after the broken one")
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+func NewFileStorage(path string) (*FileStorage, error) {
+	s := &FileStorage{
+		path: path,
+		snapshots: make(map[string]Snapshot),
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) == 0 {
+		return s, nil
+	}
+
+	err = json.Unmarshal(b, &s.snapshots)
+	if err != nil {
+		return nil, errors.New("invalid storage file: " + err.Error())
+	}
+
+	return s, nil
+}
+
+type FileStorage struct {
+	mu sync.Mutex
+	path string
+	snapshots map[string]Snapshot
+}
+
+func (s *FileStorage) Save(snap Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.snapshots[snap.UserID] = snap
+
+	return s.flush()
+}
+
+func (s *FileStorage) Load(userID string) (Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap, ok := s.snapshots[userID]
+	if !ok {
+		return Snapshot{}, SnapshotNotFoundErr
+	}
+
+	return snap, nil
+}
+
+func (s *FileStorage) LoadAll() ([]Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snaps := make([]Snapshot, 0, len(s.snapshots))
+	for _, snap := range s.snapshots {
+		snaps = append(snaps, snap)
+	}
+
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].UserID < snaps[j].UserID
+	})
+
+	return snaps, nil
+}
+
+func (s *FileStorage) Delete(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.snapshots[userID]; !ok {
+		return nil
+	}
+
+	delete(s.snapshots, userID)
+
+	return s.flush()
+}
+
+// flush writes to a temporary file first, so a crash in the middle
+// of writing never leaves a truncated storage file behind
+func (s *FileStorage) flush() error {
+	b, err := json.MarshalIndent(s.snapshots, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path) + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempStoragePath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "quest-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	return filepath.Join(dir, "progress.json")
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	s, err := NewFileStorage(tempStoragePath(t))
+	assert.NoError(t, err)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	snap := Snapshot{
+		UserID: "user-1",
+		Mission: "Mission 2",
+		Tries: map[string]int{"Mission 1": 2},
+		Clues: map[string]int{"Mission 1": 1},
+		IntroSent: true,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+
+	assert.NoError(t, s.Save(snap))
+
+	loaded, err := s.Load("user-1")
+	assert.NoError(t, err)
+	assert.Equal(t, snap, loaded)
+
+	_, err = s.Load("user-2")
+	assert.Equal(t, SnapshotNotFoundErr, err)
+}
+
+func TestSurvivesReopen(t *testing.T) {
+	path := tempStoragePath(t)
+
+	s, _ := NewFileStorage(path)
+	s.Save(Snapshot{UserID: "user-2", Mission: "Mission 1"})
+	s.Save(Snapshot{UserID: "user-1", Mission: "Mission 2", Tries: map[string]int{"Mission 1": 3}})
+
+	reopened, err := NewFileStorage(path)
+	assert.NoError(t, err)
+
+	snaps, err := reopened.LoadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(snaps))
+	assert.Equal(t, "user-1", snaps[0].UserID)
+	assert.Equal(t, "Mission 2", snaps[0].Mission)
+	assert.Equal(t, 3, snaps[0].Tries["Mission 1"])
+	assert.Equal(t, "user-2", snaps[1].UserID)
+}
+
+func TestDelete(t *testing.T) {
+	path := tempStoragePath(t)
+
+	s, _ := NewFileStorage(path)
+	s.Save(Snapshot{UserID: "user-1"})
+
+	assert.NoError(t, s.Delete("user-1"))
+	assert.NoError(t, s.Delete("user-1"))
+
+	reopened, _ := NewFileStorage(path)
+	_, err := reopened.Load("user-1")
+	assert.Equal(t, SnapshotNotFoundErr, err)
+}
+
+func TestInvalidStorageFile(t *testing.T) {
+	path := tempStoragePath(t)
+	ioutil.WriteFile(path, []byte("{invalid"), 0644)
+
+	s, err := NewFileStorage(path)
+	assert.Error(t, err)
+	assert.Nil(t, s)
+}
@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"errors"
+	"time"
+)
+
+var SnapshotNotFoundErr = errors.New("snapshot not found")
+
+type Storage interface {
+	Save(s Snapshot) error
+	Load(userID string) (Snapshot, error)
+	LoadAll() ([]Snapshot, error)
+	Delete(userID string) error
+}
+
+type Snapshot struct {
+	UserID string `json:"userId"`
+	Mission string `json:"mission"`
+	Task int `json:"task"`
+	Entry int `json:"entry"`
+	Tries map[string]int `json:"tries"`
+	Clues map[string]int `json:"clues"`
+	IntroSent bool `json:"introSent"`
+	Finished bool `json:"finished"`
+	OutroSent bool `json:"outroSent"`
+	StartedAt time.Time `json:"startedAt"`
+	TaskStartedAt time.Time `json:"taskStartedAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
@@ -0,0 +1,556 @@
+package tgtest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/merisho/quest/admin"
+	"github.com/merisho/quest/bot"
+	"github.com/merisho/quest/commandbus"
+	"github.com/merisho/quest/outbox"
+	"github.com/merisho/quest/player"
+	"github.com/merisho/quest/quest"
+	"github.com/merisho/quest/session"
+	"github.com/merisho/quest/storage"
+	"github.com/merisho/quest/transport"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	playerChat = 100
+	otherPlayerChat = 101
+	adminChat = 200
+	wait = time.Second
+)
+
+var playerConf = player.Config{
+	IntroMessage: "intro message",
+	OutroMessage: "outro message",
+	WrongAnswersForClue: 2,
+}
+
+func startGame(t *testing.T) *Server {
+	return startGameWith(t, "./test-quest.json", func(tgBot *tgbotapi.BotAPI) (*transport.Telegram, error) {
+		return transport.NewTelegram(tgBot, 1)
+	})
+}
+
+func startWebhookGame(t *testing.T, conf transport.WebhookConfig) *Server {
+	return startGameWith(t, "./test-quest.json", func(tgBot *tgbotapi.BotAPI) (*transport.Telegram, error) {
+		return transport.NewTelegramWebhook(tgBot, conf)
+	})
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+func startGameWith(t *testing.T, questFile string, newTransport func(*tgbotapi.BotAPI) (*transport.Telegram, error)) *Server {
+	s := NewServer()
+
+	tgBot, err := s.NewBot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, err := newTransport(tgBot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cb := commandbus.NewCommandBus()
+	sessions := session.NewManager(func(userID string, out transport.Output, snap *storage.Snapshot) (*player.Player, error) {
+		q, err := quest.NewQuestFromFile(questFile, out)
+		if err != nil {
+			return nil, err
+		}
+
+		conf := playerConf
+		conf.UserID = userID
+
+		return player.NewPlayer(conf, cb, q, out), nil
+	})
+
+	out := outbox.New(tr, outbox.Config{
+		MaxRetries: 3,
+		Backoff: 10 * time.Millisecond,
+		OnFailure: func(chatID, text string, err error) {
+			admin.ReportFailedSend(cb, chatID, text, err)
+		},
+	})
+
+	go bot.NewBot(out, cb, sessions).Run()
+
+	t.Cleanup(func() {
+		tr.Stop()
+		s.Close()
+		sessions.DestroyAll()
+	})
+
+	return s
+}
+
+func TestPlayerTranscript(t *testing.T) {
+	s := startGame(t)
+
+	s.SendMessage(playerChat, "Alice", "Smith", "/philadelphia")
+	assert.Equal(t, []string{
+		"intro message",
+		"Welcome to Mission 1",
+		"task 1",
+	}, s.WaitTranscript(playerChat, 3, wait))
+
+	s.SendMessage(playerChat, "Alice", "Smith", "/a wrong")
+	time.Sleep(50 * time.Millisecond)
+	s.SendMessage(playerChat, "Alice", "Smith", "/a wrong again")
+	s.WaitTranscript(playerChat, 4, wait)
+	s.SendMessage(playerChat, "Alice", "Smith", "/a answer 1")
+	s.WaitTranscript(playerChat, 6, wait)
+	s.SendMessage(playerChat, "Alice", "Smith", "/a answer 2")
+
+	assert.Equal(t, []string{
+		"intro message",
+		"Welcome to Mission 1",
+		"task 1",
+		"clue 1",
+		"Welcome to Mission 2",
+		"task 2",
+		"outro message",
+	}, s.WaitTranscript(playerChat, 7, wait))
+}
+
+func TestRestartKeepsOtherPlayers(t *testing.T) {
+	s := startGame(t)
+
+	s.SendMessage(playerChat, "Alice", "", "/philadelphia")
+	s.SendMessage(otherPlayerChat, "Bob", "", "/philadelphia")
+	s.WaitTranscript(playerChat, 3, wait)
+	s.WaitTranscript(otherPlayerChat, 3, wait)
+
+	s.SendMessage(playerChat, "Alice", "", "/a answer 1")
+	s.WaitTranscript(playerChat, 5, wait)
+
+	s.SendMessage(otherPlayerChat, "Bob", "", "/philadelphia")
+	s.WaitTranscript(otherPlayerChat, 6, wait)
+
+	s.SendMessage(playerChat, "Alice", "", "/a answer 2")
+	assert.Equal(t, "outro message", s.WaitTranscript(playerChat, 6, wait)[5])
+
+	assert.Equal(t, []string{
+		"intro message",
+		"Welcome to Mission 1",
+		"task 1",
+		"intro message",
+		"Welcome to Mission 1",
+		"task 1",
+	}, s.Transcript(otherPlayerChat))
+}
+
+func TestAdminForwards(t *testing.T) {
+	s := startGame(t)
+
+	s.SendMessage(adminChat, "Game", "Master", "/adminsecret")
+	assert.Equal(t, []string{"Hello, admin"}, s.WaitTranscript(adminChat, 1, wait))
+
+	s.SendMessage(playerChat, "Alice", "Smith", "/philadelphia")
+	s.WaitTranscript(adminChat, 4, wait)
+
+	s.SendMessage(playerChat, "Alice", "Smith", "where am I?")
+	s.WaitTranscript(adminChat, 5, wait)
+
+	s.SendMessage(playerChat, "Alice", "Smith", "/a answer 1")
+
+	assert.Equal(t, []string{
+		"Hello, admin",
+		"Quest Bot\n=====\nintro message",
+		"Quest Bot\n=====\nWelcome to Mission 1",
+		"Quest Bot\n=====\ntask 1",
+		"Alice Smith\n=====\nwhere am I?",
+		"Alice Smith\n=====\n!Answer: answer 1",
+		"Quest Bot\n=====\nWelcome to Mission 2",
+		"Quest Bot\n=====\ntask 2",
+	}, s.WaitTranscript(adminChat, 8, wait))
+}
+
+func TestAdminMessagesReachPlayers(t *testing.T) {
+	s := startGame(t)
+
+	s.SendMessage(playerChat, "Alice", "", "/philadelphia")
+	s.WaitTranscript(playerChat, 3, wait)
+
+	s.SendMessage(adminChat, "Game", "Master", "/adminmsg Hurry up!")
+
+	assert.Equal(t, "Hurry up!", s.WaitTranscript(playerChat, 4, wait)[3])
+}
+
+func TestRateLimitedMessagesAreRetried(t *testing.T) {
+	s := startGame(t)
+	s.RateLimit(playerChat, 1, 2)
+
+	start := time.Now()
+	s.SendMessage(playerChat, "Alice", "", "/philadelphia")
+
+	assert.Equal(t, []string{
+		"intro message",
+		"Welcome to Mission 1",
+		"task 1",
+	}, s.WaitTranscript(playerChat, 3, 5 * time.Second))
+	assert.True(t, time.Since(start) >= 2 * time.Second)
+}
+
+func TestAdminSeesUndeliveredMessages(t *testing.T) {
+	s := startGame(t)
+
+	s.SendMessage(adminChat, "Game", "Master", "/adminsecret")
+	s.WaitTranscript(adminChat, 1, wait)
+
+	s.Block(playerChat)
+	s.SendMessage(playerChat, "Alice", "", "/philadelphia")
+
+	transcript := s.WaitTranscript(adminChat, 7, wait)
+	assert.Contains(t, transcript, "Could not deliver to 100: Forbidden: bot was blocked by the user\n=====\nintro message")
+	assert.Contains(t, transcript, "Could not deliver to 100: Forbidden: bot was blocked by the user\n=====\ntask 1")
+	assert.Empty(t, s.Transcript(playerChat))
+}
+
+func TestAdminSeesClues(t *testing.T) {
+	s := startGame(t)
+
+	s.SendMessage(adminChat, "Game", "Master", "/adminsecret")
+	s.WaitTranscript(adminChat, 1, wait)
+
+	s.SendMessage(adminChat, "Game", "Master", "/clues")
+	assert.Equal(t, "No clues were given yet", s.WaitTranscript(adminChat, 2, wait)[1])
+
+	s.SendMessage(playerChat, "Alice", "Smith", "/philadelphia")
+	s.WaitTranscript(playerChat, 3, wait)
+	s.SendMessage(playerChat, "Alice", "Smith", "/a wrong")
+	s.SendMessage(playerChat, "Alice", "Smith", "/a wrong again")
+	s.WaitTranscript(playerChat, 4, wait)
+
+	// the clue and the notification about it are forwarded separately
+	transcript := s.WaitTranscript(adminChat, 9, wait)
+	assert.Contains(t, transcript, "Quest Bot\n=====\nclue 1")
+	assert.Contains(t, transcript, "Alice Smith (100) got clue 1/1 of Mission 1")
+
+	s.SendMessage(adminChat, "Game", "Master", "/clues")
+	assert.Equal(t, "Alice Smith (100): clue 1/1 of Mission 1", s.WaitTranscript(adminChat, 10, wait)[9])
+}
+
+func TestFormattedMessages(t *testing.T) {
+	s := startGameWith(t, "./formatted-quest.json", func(tgBot *tgbotapi.BotAPI) (*transport.Telegram, error) {
+		return transport.NewTelegram(tgBot, 1)
+	})
+
+	s.SendMessage(adminChat, "Game", "Master", "/adminsecret")
+	s.WaitTranscript(adminChat, 1, wait)
+
+	s.SendMessage(playerChat, "<i>Alice</i>", "", "/philadelphia")
+	s.WaitTranscript(playerChat, 3, wait)
+
+	sent := s.Sent(playerChat)
+	assert.Equal(t, "", sent[0].Params.Get("parse_mode"))
+	assert.Equal(t, "HTML", sent[1].Params.Get("parse_mode"))
+	assert.Equal(t, "Welcome to <b>Mission 1</b>", sent[1].Text)
+	assert.Equal(t, "", sent[2].Params.Get("parse_mode"))
+
+	s.SendMessage(playerChat, "<i>Alice</i>", "", "hi <b>there")
+
+	s.WaitTranscript(adminChat, 5, wait)
+	forwards := s.Sent(adminChat)
+	assert.Equal(t, "HTML", forwards[2].Params.Get("parse_mode"))
+	assert.Equal(t, "Quest Bot\n=====\nWelcome to <b>Mission 1</b>", forwards[2].Text)
+	assert.Equal(t, "", forwards[4].Params.Get("parse_mode"))
+	assert.Equal(t, "<i>Alice</i>\n=====\nhi <b>there", forwards[4].Text)
+
+	s.SendMessage(playerChat, "<i>Alice</i>", "", "/a wrong")
+	s.SendMessage(playerChat, "<i>Alice</i>", "", "/a wrong again")
+	s.WaitTranscript(playerChat, 4, wait)
+
+	// Telegram rejects the reserved characters of the header unless they are escaped
+	transcript := s.WaitTranscript(adminChat, 8, wait)
+	assert.Contains(t, transcript, "Quest Bot\n\\=\\=\\=\\=\\=\n||It flows||")
+}
+
+func TestMediaMessages(t *testing.T) {
+	s := startGameWith(t, "./media-quest.json", func(tgBot *tgbotapi.BotAPI) (*transport.Telegram, error) {
+		return transport.NewTelegram(tgBot, 1)
+	})
+
+	s.SendMessage(adminChat, "Game", "Master", "/adminsecret")
+	s.WaitTranscript(adminChat, 1, wait)
+
+	s.SendMessage(playerChat, "Alice", "", "/philadelphia")
+	s.WaitTranscript(playerChat, 4, wait)
+
+	sent := s.Sent(playerChat)
+	assert.Equal(t, "sendPhoto", sent[1].Method)
+	assert.Equal(t, "bridge.jpg", sent[1].File)
+	assert.Equal(t, "Welcome to the <b>bridge</b>", sent[1].Text)
+	assert.Equal(t, "HTML", sent[1].Params.Get("parse_mode"))
+
+	assert.Equal(t, "sendLocation", sent[2].Method)
+	assert.Equal(t, "55.753900", sent[2].Params.Get("latitude"))
+	assert.Equal(t, "37.620800", sent[2].Params.Get("longitude"))
+	assert.Equal(t, "sendMessage", sent[3].Method)
+	assert.Equal(t, "Come here", sent[3].Text)
+
+	assert.Equal(t, []string{
+		"Hello, admin",
+		"Quest Bot\n=====\nintro message",
+		"Quest Bot\n=====\n[photo: bridge.jpg]\nWelcome to the <b>bridge</b>",
+		"Quest Bot\n=====\n[location: 55.7539, 37.6208]\nCome here",
+	}, s.WaitTranscript(adminChat, 4, wait))
+}
+
+func TestChoiceButtons(t *testing.T) {
+	s := startGameWith(t, "./choices-quest.json", func(tgBot *tgbotapi.BotAPI) (*transport.Telegram, error) {
+		return transport.NewTelegram(tgBot, 1)
+	})
+
+	s.SendMessage(adminChat, "Game", "Master", "/adminsecret")
+	s.WaitTranscript(adminChat, 1, wait)
+
+	s.SendMessage(playerChat, "Alice", "", "/philadelphia")
+	s.WaitTranscript(playerChat, 2, wait)
+
+	question := s.Sent(playerChat)[1]
+	assert.Equal(t, "What is the capital of France?", question.Text)
+
+	buttons := question.Buttons()
+	assert.Len(t, buttons, 2)
+	assert.True(t, strings.HasSuffix(buttons["Paris"], ":Paris"), buttons["Paris"])
+
+	id := s.PressButton(playerChat, "Alice", "", question.MessageID, buttons["Paris"])
+	text, ok := s.Answered(id, wait)
+	assert.True(t, ok, "the press must be acknowledged")
+	assert.Equal(t, "Paris", text)
+
+	assert.Equal(t, "What is the capital of England?", s.WaitTranscript(playerChat, 3, wait)[2])
+	assert.Contains(t, s.WaitTranscript(adminChat, 5, wait), "Alice\n=====\n!Answer: Paris")
+}
+
+func TestStaleButtonPress(t *testing.T) {
+	s := startGameWith(t, "./choices-quest.json", func(tgBot *tgbotapi.BotAPI) (*transport.Telegram, error) {
+		return transport.NewTelegram(tgBot, 1)
+	})
+
+	s.SendMessage(playerChat, "Alice", "", "/philadelphia")
+	s.WaitTranscript(playerChat, 2, wait)
+
+	france := s.Sent(playerChat)[1]
+	s.PressButton(playerChat, "Alice", "", france.MessageID, france.Buttons()["Paris"])
+	s.WaitTranscript(playerChat, 3, wait)
+
+	// the keyboard of the first task is still there, and London is correct for the second one
+	for i := 0; i < 3; i++ {
+		id := s.PressButton(playerChat, "Alice", "", france.MessageID, france.Buttons()["London"])
+		_, ok := s.Answered(id, wait)
+		assert.True(t, ok, "the stale press must be acknowledged")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{
+		"intro message",
+		"What is the capital of France?",
+		"What is the capital of England?",
+	}, s.Transcript(playerChat), "stale presses must neither answer the task nor count as wrong answers")
+
+	england := s.Sent(playerChat)[2]
+	s.PressButton(playerChat, "Alice", "", england.MessageID, england.Buttons()["London"])
+	assert.Equal(t, "task 3", s.WaitTranscript(playerChat, 4, wait)[3])
+}
+
+func TestLocationTask(t *testing.T) {
+	s := startGameWith(t, "./location-quest.json", func(tgBot *tgbotapi.BotAPI) (*transport.Telegram, error) {
+		return transport.NewTelegram(tgBot, 1)
+	})
+
+	s.SendMessage(adminChat, "Game", "Master", "/adminsecret")
+	s.WaitTranscript(adminChat, 1, wait)
+
+	s.SendMessage(playerChat, "Alice", "", "/philadelphia")
+	s.WaitTranscript(playerChat, 2, wait)
+
+	id := s.ShareLocation(playerChat, "Alice", "", 55.7520, 37.6175)
+	assert.Contains(t, s.WaitTranscript(adminChat, 4, wait), "Alice\n=====\n!Answer: [location: 55.752, 37.6175]")
+
+	s.MoveLiveLocation(playerChat, "Alice", "", id, 55.7545, 37.6210)
+	assert.Equal(t, []string{
+		"intro message",
+		"Come to the Red Square",
+		"task 2",
+	}, s.WaitTranscript(playerChat, 3, wait))
+}
+
+func TestWebhookMode(t *testing.T) {
+	addr := freeAddr(t)
+	s := startWebhookGame(t, transport.WebhookConfig{
+		URL: "http://" + addr + "/telegram",
+		Listen: addr,
+		SecretToken: "s3cr3t",
+	})
+
+	hook, secret := s.Webhook()
+	assert.Equal(t, "http://" + addr + "/telegram", hook)
+	assert.Equal(t, "s3cr3t", secret)
+
+	s.SendMessage(playerChat, "Alice", "Smith", "/philadelphia")
+	s.WaitTranscript(playerChat, 3, wait)
+	s.SendMessage(playerChat, "Alice", "Smith", "/a answer 1")
+
+	assert.Equal(t, []string{
+		"intro message",
+		"Welcome to Mission 1",
+		"task 1",
+		"Welcome to Mission 2",
+		"task 2",
+	}, s.WaitTranscript(playerChat, 5, wait))
+}
+
+// selfSignedCert writes a self-signed certificate of the host and its key to the files
+func selfSignedCert(t *testing.T, host string) (string, string) {
+	dir, err := ioutil.TempDir("", "quest-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: host},
+		IPAddresses: []net.IP{net.ParseIP(host)},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+
+	return certFile, keyFile
+}
+
+func TestWebhookSelfSignedCertificate(t *testing.T) {
+	addr := freeAddr(t)
+	host, _, _ := net.SplitHostPort(addr)
+	certFile, keyFile := selfSignedCert(t, host)
+
+	s := startWebhookGame(t, transport.WebhookConfig{
+		URL: "https://" + addr + "/telegram",
+		Listen: addr,
+		SecretToken: "s3cr3t",
+		CertFile: certFile,
+		KeyFile: keyFile,
+		SelfSigned: true,
+	})
+
+	cert, _ := ioutil.ReadFile(certFile)
+	assert.Equal(t, string(cert), s.WebhookCertificate(), "the certificate must be uploaded with the webhook")
+
+	// the server trusts only the uploaded certificate
+	s.SendMessage(playerChat, "Alice", "Smith", "/philadelphia")
+	assert.Equal(t, []string{
+		"intro message",
+		"Welcome to Mission 1",
+		"task 1",
+	}, s.WaitTranscript(playerChat, 3, wait))
+}
+
+func TestWebhookRejectsWrongSecret(t *testing.T) {
+	addr := freeAddr(t)
+	startWebhookGame(t, transport.WebhookConfig{
+		URL: "http://" + addr + "/telegram",
+		Listen: addr,
+		SecretToken: "s3cr3t",
+	})
+
+	body := `{"update_id": 1, "message": {"message_id": 1, "chat": {"id": 100}, "text": "/philadelphia"}}`
+
+	resp, err := http.Post("http://" + addr + "/telegram", "application/json", strings.NewReader(body))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, _ := http.NewRequest(http.MethodPost, "http://" + addr + "/telegram", strings.NewReader(body))
+	req.Header.Set("X-Telegram-Bot-Api-Secret-Token", "wrong")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestWebhookRequiresSecret(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	tgBot, err := s.NewBot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := freeAddr(t)
+	_, err = transport.NewTelegramWebhook(tgBot, transport.WebhookConfig{
+		URL: "http://" + addr + "/telegram",
+		Listen: addr,
+	})
+	assert.Error(t, err)
+
+	hook, _ := s.Webhook()
+	assert.Equal(t, "", hook, "must NOT register the webhook without the secret")
+}
+
+func TestPollingRemovesWebhook(t *testing.T) {
+	addr := freeAddr(t)
+	s := startWebhookGame(t, transport.WebhookConfig{
+		URL: "http://" + addr + "/telegram",
+		Listen: addr,
+		SecretToken: "s3cr3t",
+	})
+
+	tgBot, _ := s.NewBot()
+	tr, err := transport.NewTelegram(tgBot, 1)
+	assert.NoError(t, err)
+	defer tr.Stop()
+
+	hook, _ := s.Webhook()
+	assert.Equal(t, "", hook)
+}
@@ -0,0 +1,656 @@
+package tgtest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const Token = "test-token"
+
+var BotUser = tgbotapi.User{
+	ID: 1,
+	FirstName: "Quest",
+	LastName: "Bot",
+	UserName: "quest_bot",
+	IsBot: true,
+}
+
+// Server is an in-process stand-in for the Telegram Bot API. It queues updates
+// for getUpdates and records everything the bot sends to the chats
+func NewServer() *Server {
+	s := &Server{
+		sent: make(map[int64][]Sent),
+		rateLimits: make(map[int64]rateLimit),
+		blocked: make(map[int64]bool),
+		answered: make(map[string]string),
+		changed: make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.handle))
+
+	return s
+}
+
+type Server struct {
+	srv *httptest.Server
+	mu sync.Mutex
+	updates []tgbotapi.Update
+	lastUpdateID int
+	lastMessageID int
+	sent map[int64][]Sent
+	webhook url.Values
+	rateLimits map[int64]rateLimit
+	blocked map[int64]bool
+	answered map[string]string
+	lastCallbackID int
+	changed chan struct{}
+	closed chan struct{}
+	closeOnce sync.Once
+}
+
+type rateLimit struct {
+	retryAfter int
+	times int
+}
+
+// Sent is a message the bot sent to a chat
+type Sent struct {
+	ChatID int64
+	// Method is the method of the Bot API the message was sent with, like sendPhoto
+	Method string
+	// Text is the text of the message or the caption of the media
+	Text string
+	Params url.Values
+	// File is the name of the uploaded file, if any
+	File string
+	// MessageID is the ID the server gave to the message
+	MessageID int
+}
+
+// Buttons are the data of the buttons of the inline keyboard by their text
+func (s Sent) Buttons() map[string]string {
+	var markup tgbotapi.InlineKeyboardMarkup
+	if err := json.Unmarshal([]byte(s.Params.Get("reply_markup")), &markup); err != nil {
+		return nil
+	}
+
+	buttons := make(map[string]string)
+	for _, row := range markup.InlineKeyboard {
+		for _, b := range row {
+			if b.CallbackData != nil {
+				buttons[b.Text] = *b.CallbackData
+			}
+		}
+	}
+
+	return buttons
+}
+
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// Client sends all the requests to api.telegram.org to the server
+func (s *Server) Client() *http.Client {
+	target, _ := url.Parse(s.srv.URL)
+
+	return &http.Client{
+		Transport: &redirectTransport{
+			target: target,
+			next: http.DefaultTransport,
+		},
+	}
+}
+
+func (s *Server) NewBot() (*tgbotapi.BotAPI, error) {
+	return tgbotapi.NewBotAPIWithClient(Token, s.Client())
+}
+
+// SendMessage makes a user write the text to the bot in the private chat.
+// If the webhook is set, the update is posted to it, otherwise it waits for getUpdates
+func (s *Server) SendMessage(chatID int64, firstName, lastName, text string) {
+	s.mu.Lock()
+	s.lastMessageID++
+	msg := userMessage(chatID, firstName, lastName, s.lastMessageID)
+	msg.Text = text
+	u := s.addUpdate(tgbotapi.Update{Message: msg})
+	webhook := s.webhook
+	s.mu.Unlock()
+
+	if webhook.Get("url") != "" {
+		s.postWebhook(webhook, u)
+	}
+}
+
+// ShareLocation makes a user send the location to the bot. It returns the ID
+// of the message, which is needed to move the location if it is live
+func (s *Server) ShareLocation(chatID int64, firstName, lastName string, latitude, longitude float64) int {
+	s.mu.Lock()
+	s.lastMessageID++
+	id := s.lastMessageID
+	msg := userMessage(chatID, firstName, lastName, id)
+	msg.Location = &tgbotapi.Location{Latitude: latitude, Longitude: longitude}
+	u := s.addUpdate(tgbotapi.Update{Message: msg})
+	webhook := s.webhook
+	s.mu.Unlock()
+
+	if webhook.Get("url") != "" {
+		s.postWebhook(webhook, u)
+	}
+
+	return id
+}
+
+// MoveLiveLocation updates the live location shared in the message, as Telegram
+// does while the user moves
+func (s *Server) MoveLiveLocation(chatID int64, firstName, lastName string, messageID int, latitude, longitude float64) {
+	s.mu.Lock()
+	msg := userMessage(chatID, firstName, lastName, messageID)
+	msg.EditDate = int(time.Now().Unix())
+	msg.Location = &tgbotapi.Location{Latitude: latitude, Longitude: longitude}
+	u := s.addUpdate(tgbotapi.Update{EditedMessage: msg})
+	webhook := s.webhook
+	s.mu.Unlock()
+
+	if webhook.Get("url") != "" {
+		s.postWebhook(webhook, u)
+	}
+}
+
+func userMessage(chatID int64, firstName, lastName string, messageID int) *tgbotapi.Message {
+	return &tgbotapi.Message{
+		MessageID: messageID,
+		From: &tgbotapi.User{
+			ID: int(chatID),
+			FirstName: firstName,
+			LastName: lastName,
+		},
+		Date: int(time.Now().Unix()),
+		Chat: &tgbotapi.Chat{
+			ID: chatID,
+			Type: "private",
+		},
+	}
+}
+
+// PressButton makes a user press the inline button with the data under the message
+// the bot sent to the chat. It returns the ID of the callback query
+func (s *Server) PressButton(chatID int64, firstName, lastName string, messageID int, data string) string {
+	s.mu.Lock()
+	s.lastCallbackID++
+	id := strconv.Itoa(s.lastCallbackID)
+	u := s.addUpdate(tgbotapi.Update{
+		CallbackQuery: &tgbotapi.CallbackQuery{
+			ID: id,
+			From: &tgbotapi.User{
+				ID: int(chatID),
+				FirstName: firstName,
+				LastName: lastName,
+			},
+			Message: &tgbotapi.Message{
+				MessageID: messageID,
+				From: &BotUser,
+				Chat: &tgbotapi.Chat{
+					ID: chatID,
+					Type: "private",
+				},
+			},
+			Data: data,
+		},
+	})
+	webhook := s.webhook
+	s.mu.Unlock()
+
+	if webhook.Get("url") != "" {
+		s.postWebhook(webhook, u)
+	}
+
+	return id
+}
+
+// Answered waits until the bot answers the callback query and returns the text of the answer
+func (s *Server) Answered(callbackID string, timeout time.Duration) (string, bool) {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		text, ok := s.answered[callbackID]
+		changed := s.changed
+		s.mu.Unlock()
+
+		if ok {
+			return text, true
+		}
+
+		select {
+		case <- changed:
+		case <- deadline:
+			return "", false
+		}
+	}
+}
+
+// WebhookCertificate is the certificate uploaded with the webhook, if any.
+// The server trusts it when it sends updates to the webhook, as Telegram does
+func (s *Server) WebhookCertificate() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.webhook.Get("certificate")
+}
+
+// Webhook is the URL and the secret token set by the bot, if any
+func (s *Server) Webhook() (string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.webhook.Get("url"), s.webhook.Get("secret_token")
+}
+
+func (s *Server) postWebhook(webhook url.Values, u tgbotapi.Update) {
+	b, _ := json.Marshal(u)
+
+	req, err := http.NewRequest(http.MethodPost, webhook.Get("url"), bytes.NewReader(b))
+	if err != nil {
+		panic(err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if secret := webhook.Get("secret_token"); secret != "" {
+		req.Header.Set("X-Telegram-Bot-Api-Secret-Token", secret)
+	}
+
+	client := http.DefaultClient
+	if cert := webhook.Get("certificate"); cert != "" {
+		roots := x509.NewCertPool()
+		roots.AppendCertsFromPEM([]byte(cert))
+		client = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}},
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		panic("webhook responded with " + resp.Status)
+	}
+}
+
+// Transcript is the texts sent to the chat so far
+func (s *Server) Transcript(chatID int64) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var texts []string
+	for _, m := range s.sent[chatID] {
+		texts = append(texts, m.Text)
+	}
+
+	return texts
+}
+
+// WaitTranscript waits until at least n messages are sent to the chat
+// and returns the transcript, which may be shorter on timeout
+func (s *Server) WaitTranscript(chatID int64, n int, timeout time.Duration) []string {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		ready := len(s.sent[chatID]) >= n
+		changed := s.changed
+		s.mu.Unlock()
+
+		if ready {
+			return s.Transcript(chatID)
+		}
+
+		select {
+		case <- changed:
+		case <- deadline:
+			return s.Transcript(chatID)
+		}
+	}
+}
+
+// Sent is everything sent to the chat including the request parameters
+func (s *Server) Sent(chatID int64) []Sent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Sent(nil), s.sent[chatID]...)
+}
+
+// RateLimit makes the next messages to the chat fail with 429 Too Many Requests
+// and asks to retry after the given number of seconds
+func (s *Server) RateLimit(chatID int64, retryAfter, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rateLimits[chatID] = rateLimit{
+		retryAfter: retryAfter,
+		times: times,
+	}
+}
+
+// Block makes all the messages to the chat fail as if the user blocked the bot
+func (s *Server) Block(chatID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blocked[chatID] = true
+}
+
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	s.srv.Close()
+}
+
+func (s *Server) addUpdate(u tgbotapi.Update) tgbotapi.Update {
+	s.lastUpdateID++
+	u.UpdateID = s.lastUpdateID
+	if s.webhook.Get("url") == "" {
+		s.updates = append(s.updates, u)
+		s.notify()
+	}
+
+	return u
+}
+
+// notify wakes up everyone waiting for changes. Must be called with the lock held
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 2 || parts[0] != "bot" + Token {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var file string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(10 << 20); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		for k, v := range r.MultipartForm.Value {
+			r.Form[k] = v
+		}
+		for field, headers := range r.MultipartForm.File {
+			file = headers[0].Filename
+
+			// the certificate of the webhook is kept to trust the webhook server
+			if field == "certificate" {
+				cert, err := readUpload(headers[0])
+				if err != nil {
+					writeError(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				r.Form.Set("certificate", string(cert))
+			}
+		}
+	}
+
+	switch parts[1] {
+	case "getMe":
+		writeResult(w, BotUser)
+	case "getUpdates":
+		s.getUpdates(w, r.Form)
+	case "sendMessage", "sendPhoto", "sendAudio", "sendDocument", "sendLocation":
+		s.sendMessage(w, parts[1], r.Form, file)
+	case "answerCallbackQuery":
+		s.answerCallbackQuery(w, r.Form)
+	case "setWebhook":
+		s.setWebhook(w, r.Form)
+	default:
+		writeError(w, http.StatusNotFound, "Not Found: method " + parts[1])
+	}
+}
+
+func (s *Server) setWebhook(w http.ResponseWriter, form url.Values) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if form.Get("url") == "" {
+		s.webhook = nil
+	} else {
+		s.webhook = form
+	}
+
+	writeResult(w, true)
+}
+
+func (s *Server) answerCallbackQuery(w http.ResponseWriter, form url.Values) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := form.Get("callback_query_id")
+	if _, ok := s.answered[id]; ok {
+		writeError(w, http.StatusBadRequest, "Bad Request: query is too old and response timeout expired or query ID is invalid")
+		return
+	}
+
+	s.answered[id] = form.Get("text")
+	s.notify()
+
+	writeResult(w, true)
+}
+
+func (s *Server) getUpdates(w http.ResponseWriter, form url.Values) {
+	s.mu.Lock()
+	webhookSet := s.webhook.Get("url") != ""
+	s.mu.Unlock()
+
+	if webhookSet {
+		writeError(w, http.StatusConflict, "Conflict: can't use getUpdates method while webhook is active")
+		return
+	}
+
+	offset, _ := strconv.Atoi(form.Get("offset"))
+	timeout, _ := strconv.Atoi(form.Get("timeout"))
+	deadline := time.After(time.Duration(timeout) * time.Second)
+
+	for {
+		s.mu.Lock()
+		var updates []tgbotapi.Update
+		for _, u := range s.updates {
+			if u.UpdateID >= offset {
+				updates = append(updates, u)
+			}
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		if len(updates) > 0 || timeout == 0 {
+			writeResult(w, updates)
+			return
+		}
+
+		select {
+		case <- changed:
+		case <- deadline:
+			writeResult(w, []tgbotapi.Update{})
+			return
+		case <- s.closed:
+			writeResult(w, []tgbotapi.Update{})
+			return
+		}
+	}
+}
+
+func (s *Server) sendMessage(w http.ResponseWriter, method string, form url.Values, file string) {
+	chatID, err := strconv.ParseInt(form.Get("chat_id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Bad Request: chat not found")
+		return
+	}
+
+	text := form.Get("text")
+	switch method {
+	case "sendMessage":
+		if text == "" {
+			writeError(w, http.StatusBadRequest, "Bad Request: message text is empty")
+			return
+		}
+	case "sendLocation":
+		if form.Get("latitude") == "" || form.Get("longitude") == "" {
+			writeError(w, http.StatusBadRequest, "Bad Request: location is missing")
+			return
+		}
+	default:
+		if file == "" {
+			writeError(w, http.StatusBadRequest, "Bad Request: there is no file in the request")
+			return
+		}
+		text = form.Get("caption")
+	}
+
+	if form.Get("parse_mode") == "MarkdownV2" {
+		if err := checkMarkdownV2(text); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	s.mu.Lock()
+	if s.blocked[chatID] {
+		s.mu.Unlock()
+		writeError(w, http.StatusForbidden, "Forbidden: bot was blocked by the user")
+		return
+	}
+
+	if limit := s.rateLimits[chatID]; limit.times > 0 {
+		limit.times--
+		s.rateLimits[chatID] = limit
+		s.mu.Unlock()
+		writeRetryAfter(w, limit.retryAfter)
+		return
+	}
+
+	s.lastMessageID++
+	msg := tgbotapi.Message{
+		MessageID: s.lastMessageID,
+		From: &BotUser,
+		Date: int(time.Now().Unix()),
+		Chat: &tgbotapi.Chat{ID: chatID, Type: "private"},
+		Text: text,
+	}
+	s.sent[chatID] = append(s.sent[chatID], Sent{
+		ChatID: chatID,
+		Method: method,
+		Text: text,
+		Params: form,
+		File: file,
+		MessageID: s.lastMessageID,
+	})
+	s.notify()
+	s.mu.Unlock()
+
+	writeResult(w, msg)
+}
+
+// markdownV2Reserved are the characters Telegram rejects in MarkdownV2 unless they
+// are escaped. The ones which are also the markup of entities are not checked
+const markdownV2Reserved = "#+-=.!{}"
+
+// checkMarkdownV2 finds the reserved characters which are not escaped, like Telegram does
+func checkMarkdownV2(text string) error {
+	escaped := false
+	for _, c := range text {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case strings.ContainsRune(markdownV2Reserved, c):
+			return fmt.Errorf("Bad Request: can't parse entities: Character '%c' is reserved and must be escaped with the preceding '\\'", c)
+		}
+	}
+
+	return nil
+}
+
+func writeResult(w http.ResponseWriter, result interface{}) {
+	b, err := json.Marshal(result)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	json.NewEncoder(w).Encode(tgbotapi.APIResponse{
+		Ok: true,
+		Result: b,
+	})
+}
+
+func writeError(w http.ResponseWriter, code int, description string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(tgbotapi.APIResponse{
+		Ok: false,
+		ErrorCode: code,
+		Description: description,
+	})
+}
+
+func writeRetryAfter(w http.ResponseWriter, seconds int) {
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(tgbotapi.APIResponse{
+		Ok: false,
+		ErrorCode: http.StatusTooManyRequests,
+		Description: fmt.Sprintf("Too Many Requests: retry after %d", seconds),
+		Parameters: &tgbotapi.ResponseParameters{RetryAfter: seconds},
+	})
+}
+
+type redirectTransport struct {
+	target *url.URL
+	next http.RoundTripper
+}
+
+func (t *redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Host != "api.telegram.org" {
+		return nil, fmt.Errorf("unexpected request to %s", r.URL.Host)
+	}
+
+	redirected := r.Clone(r.Context())
+	redirected.URL.Scheme = t.target.Scheme
+	redirected.URL.Host = t.target.Host
+	redirected.Host = t.target.Host
+
+	return t.next.RoundTrip(redirected)
+}
+
+func readUpload(h *multipart.FileHeader) ([]byte, error) {
+	f, err := h.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
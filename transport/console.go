@@ -0,0 +1,113 @@
+package transport
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+const ConsoleChatID = "1"
+
+// Console plays the quest in a terminal. Every input line is a message
+// of the console chat. A line like "@2 /adminsecret" is sent from chat 2,
+// which makes it possible to rehearse with several chats at once.
+// A line like "[yes]" presses the button with the data "yes"
+// and "[location: 55.7539, 37.6208]" shares the location.
+// Outgoing messages are printed with the chat they are sent to
+func NewConsole(in io.Reader, out io.Writer) *Console {
+	c := &Console{
+		out: out,
+		messages: make(chan Message),
+	}
+
+	go c.read(in)
+
+	return c
+}
+
+type Console struct {
+	mu sync.Mutex
+	out io.Writer
+	messages chan Message
+}
+
+func (c *Console) Messages() <-chan Message {
+	return c.messages
+}
+
+func (c *Console) Output(chatID string) Output {
+	return &consoleOutput{
+		console: c,
+		chatID: chatID,
+	}
+}
+
+func (c *Console) SelfName() string {
+	return "Quest Bot"
+}
+
+func (c *Console) read(in io.Reader) {
+	defer close(c.messages)
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		chatID := ConsoleChatID
+		if strings.HasPrefix(line, "@") {
+			parts := strings.SplitN(line[1:], " ", 2)
+			chatID = parts[0]
+			line = ""
+			if len(parts) == 2 {
+				line = strings.TrimSpace(parts[1])
+			}
+		}
+
+		msg := Message{
+			ChatID: chatID,
+			Text: line,
+			SenderName: "Player " + chatID,
+		}
+		var p Point
+		if _, err := fmt.Sscanf(line, "[location: %g, %g]", &p.Latitude, &p.Longitude); err == nil {
+			msg.Text = ""
+			msg.Location = &p
+		} else if len(line) > 2 && strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			msg.Text = line[1:len(line) - 1]
+			msg.CallbackID = "console"
+		}
+
+		c.messages <- msg
+	}
+}
+
+func (c *Console) print(chatID string, msg string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return fmt.Fprintf(c.out, "[%s] %s\n", chatID, msg)
+}
+
+type consoleOutput struct {
+	console *Console
+	chatID string
+}
+
+func (o *consoleOutput) Send(msg Outgoing) error {
+	text := msg.String()
+	for _, row := range msg.Keyboard {
+		var buttons []string
+		for _, b := range row {
+			buttons = append(buttons, "[" + b.Text + "]")
+		}
+		text += "\n" + strings.Join(buttons, " ")
+	}
+
+	_, err := o.console.print(o.chatID, text)
+	return err
+}
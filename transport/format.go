@@ -0,0 +1,72 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ParseMode tells how the formatting of a message is written.
+// The values are the parse modes of the Telegram Bot API
+type ParseMode string
+
+const (
+	PlainText ParseMode = ""
+	Markdown ParseMode = "Markdown"
+	MarkdownV2 ParseMode = "MarkdownV2"
+	HTML ParseMode = "HTML"
+)
+
+func (m *ParseMode) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	switch mode := ParseMode(s); mode {
+	case PlainText, Markdown, MarkdownV2, HTML:
+		*m = mode
+		return nil
+	}
+
+	return fmt.Errorf("unknown parse mode %q", s)
+}
+
+var (
+	markdownEscaper = strings.NewReplacer(
+		"_", "\\_",
+		"*", "\\*",
+		"`", "\\`",
+		"[", "\\[",
+	)
+	markdownV2Escaper = newBackslashEscaper("\\_*[]()~`>#+-=|{}.!")
+	htmlEscaper = strings.NewReplacer(
+		"&", "&amp;",
+		"<", "&lt;",
+		">", "&gt;",
+	)
+)
+
+func newBackslashEscaper(chars string) *strings.Replacer {
+	var pairs []string
+	for _, c := range chars {
+		pairs = append(pairs, string(c), "\\" + string(c))
+	}
+
+	return strings.NewReplacer(pairs...)
+}
+
+// Escape makes the text, usually written by players, safe to put
+// into a message of the parse mode, so it is shown as is
+func Escape(text string, mode ParseMode) string {
+	switch mode {
+	case Markdown:
+		return markdownEscaper.Replace(text)
+	case MarkdownV2:
+		return markdownV2Escaper.Replace(text)
+	case HTML:
+		return htmlEscaper.Replace(text)
+	default:
+		return text
+	}
+}
@@ -0,0 +1,113 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// Outgoing is a message of the game to a chat. Text is the caption
+// if the message has media
+type Outgoing struct {
+	Text string
+	ParseMode ParseMode
+	Media *Media
+	Kind Kind
+	// ReplyTo is the ID of the message in the chat this one answers, if any
+	ReplyTo int
+	// Keyboard is the rows of buttons under the message
+	Keyboard [][]Button
+}
+
+// Kind tells what the message is for, so transports and
+// the admin can treat, e.g., clues differently from the story
+type Kind string
+
+const (
+	StoryMessage Kind = "story"
+	StatementMessage Kind = "statement"
+	ClueMessage Kind = "clue"
+	SystemMessage Kind = "system"
+	ForwardMessage Kind = "forward"
+)
+
+// MaxButtonData is the limit of the data of a button in bytes
+const MaxButtonData = 64
+
+// Button of a keyboard. Data comes back with the press of the button
+type Button struct {
+	Text string
+	Data string
+}
+
+type MediaType string
+
+const (
+	Photo MediaType = "photo"
+	Audio MediaType = "audio"
+	Document MediaType = "document"
+	Location MediaType = "location"
+)
+
+// Media is a local file to upload or, for locations, a point on the map
+type Media struct {
+	Type MediaType `json:"type"`
+	File string `json:"file"`
+	Latitude float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+func (m Media) String() string {
+	if m.Type == Location {
+		return Point{Latitude: m.Latitude, Longitude: m.Longitude}.String()
+	}
+
+	return fmt.Sprintf("[%s: %s]", m.Type, filepath.Base(m.File))
+}
+
+// Point is a place on the map
+type Point struct {
+	Latitude float64
+	Longitude float64
+}
+
+func (p Point) String() string {
+	return fmt.Sprintf("[location: %g, %g]", p.Latitude, p.Longitude)
+}
+
+// String is the message as text, the media is described in brackets
+func (m Outgoing) String() string {
+	if m.Media == nil {
+		return m.Text
+	}
+
+	media := Escape(m.Media.String(), m.ParseMode)
+	if m.Text == "" {
+		return media
+	}
+
+	return media + "\n" + m.Text
+}
+
+// Output receives the messages of the game to a chat
+type Output interface {
+	Send(msg Outgoing) error
+}
+
+// WriterOutput adapts a plain writer, the messages are written as text
+func WriterOutput(w io.Writer) Output {
+	if out, ok := w.(Output); ok {
+		return out
+	}
+
+	return &writerOutput{w}
+}
+
+type writerOutput struct {
+	w io.Writer
+}
+
+func (o *writerOutput) Send(msg Outgoing) error {
+	_, err := o.w.Write([]byte(msg.String()))
+	return err
+}
@@ -0,0 +1,267 @@
+package transport
+
+import (
+	"fmt"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewTelegram receives updates by long polling. Telegram does not allow
+// polling while a webhook is set, so the webhook is removed first
+func NewTelegram(bot *tgbotapi.BotAPI, timeout int) (*Telegram, error) {
+	if _, err := bot.RemoveWebhook(); err != nil {
+		return nil, err
+	}
+
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = timeout
+
+	updates, err := bot.GetUpdatesChan(u)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Telegram{
+		bot: bot,
+		messages: make(chan Message),
+		stop: bot.StopReceivingUpdates,
+	}
+
+	go t.receive(updates)
+
+	return t, nil
+}
+
+type Telegram struct {
+	bot *tgbotapi.BotAPI
+	messages chan Message
+	stop func()
+}
+
+func (t *Telegram) Messages() <-chan Message {
+	return t.messages
+}
+
+func (t *Telegram) Output(chatID string) Output {
+	id, _ := strconv.ParseInt(chatID, 10, 64)
+
+	return &telegramOutput{
+		id: id,
+		bot: t.bot,
+	}
+}
+
+func (t *Telegram) SelfName() string {
+	return fullName(t.bot.Self)
+}
+
+// Stop stops receiving updates from Telegram
+func (t *Telegram) Stop() {
+	t.stop()
+}
+
+func (t *Telegram) receive(updates tgbotapi.UpdatesChannel) {
+	defer close(t.messages)
+
+	for update := range updates {
+		if update.CallbackQuery != nil {
+			if press, ok := buttonPress(update.CallbackQuery); ok {
+				t.messages <- press
+			}
+			continue
+		}
+
+		// edits of messages are only interesting as the updates of live locations
+		msg, live := update.Message, false
+		if msg == nil && update.EditedMessage != nil && update.EditedMessage.Location != nil {
+			msg, live = update.EditedMessage, true
+		}
+		if msg == nil {
+			continue
+		}
+
+		var sender string
+		if msg.From != nil {
+			sender = fullName(*msg.From)
+		}
+
+		m := Message{
+			ID: msg.MessageID,
+			ChatID: strconv.FormatInt(msg.Chat.ID, 10),
+			Text: msg.Text,
+			SenderName: sender,
+			Live: live,
+		}
+		if msg.Location != nil {
+			m.Location = &Point{
+				Latitude: msg.Location.Latitude,
+				Longitude: msg.Location.Longitude,
+			}
+		}
+
+		t.messages <- m
+	}
+}
+
+// buttonPress is the message of the press of an inline button. Presses of buttons
+// of inline queries have no chat, so they are dropped
+func buttonPress(q *tgbotapi.CallbackQuery) (Message, bool) {
+	if q.Message == nil || q.Message.Chat == nil {
+		return Message{}, false
+	}
+
+	var sender string
+	if q.From != nil {
+		sender = fullName(*q.From)
+	}
+
+	return Message{
+		ID: q.Message.MessageID,
+		ChatID: strconv.FormatInt(q.Message.Chat.ID, 10),
+		Text: q.Data,
+		SenderName: sender,
+		CallbackID: q.ID,
+	}, true
+}
+
+// Acknowledge answers the callback query, which stops the progress indicator
+// on the button and shows the text as a notification
+func (t *Telegram) Acknowledge(press Message, text string) error {
+	if _, err := t.bot.AnswerCallbackQuery(tgbotapi.NewCallback(press.CallbackID, text)); err != nil {
+		return sendError(err)
+	}
+
+	return nil
+}
+
+type telegramOutput struct {
+	id int64
+	bot *tgbotapi.BotAPI
+}
+
+func (o *telegramOutput) Send(msg Outgoing) error {
+	if _, err := o.bot.Send(o.chattable(msg)); err != nil {
+		return sendError(err)
+	}
+
+	// locations have no caption, so it goes in the next message
+	if msg.Media != nil && msg.Media.Type == Location && msg.Text != "" {
+		return o.Send(Outgoing{
+			Text: msg.Text,
+			ParseMode: msg.ParseMode,
+			Kind: msg.Kind,
+			Keyboard: msg.Keyboard,
+		})
+	}
+
+	return nil
+}
+
+func (o *telegramOutput) chattable(msg Outgoing) tgbotapi.Chattable {
+	base := tgbotapi.BaseChat{
+		ChatID: o.id,
+		ReplyToMessageID: msg.ReplyTo,
+	}
+	if len(msg.Keyboard) > 0 && (msg.Media == nil || msg.Media.Type != Location || msg.Text == "") {
+		base.ReplyMarkup = inlineKeyboard(msg.Keyboard)
+	}
+
+	if msg.Media == nil {
+		return tgbotapi.MessageConfig{
+			BaseChat: base,
+			Text: msg.Text,
+			ParseMode: string(msg.ParseMode),
+		}
+	}
+
+	file := tgbotapi.BaseFile{
+		BaseChat: base,
+		File: msg.Media.File,
+	}
+
+	switch msg.Media.Type {
+	case Photo:
+		return tgbotapi.PhotoConfig{BaseFile: file, Caption: msg.Text, ParseMode: string(msg.ParseMode)}
+	case Audio:
+		return tgbotapi.AudioConfig{BaseFile: file, Caption: msg.Text, ParseMode: string(msg.ParseMode)}
+	case Location:
+		return tgbotapi.LocationConfig{BaseChat: base, Latitude: msg.Media.Latitude, Longitude: msg.Media.Longitude}
+	default:
+		return tgbotapi.DocumentConfig{BaseFile: file, Caption: msg.Text, ParseMode: string(msg.ParseMode)}
+	}
+}
+
+func inlineKeyboard(rows [][]Button) tgbotapi.InlineKeyboardMarkup {
+	var keyboard [][]tgbotapi.InlineKeyboardButton
+	for _, row := range rows {
+		var buttons []tgbotapi.InlineKeyboardButton
+		for _, b := range row {
+			buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(b.Text, b.Data))
+		}
+		keyboard = append(keyboard, buttons)
+	}
+
+	return tgbotapi.NewInlineKeyboardMarkup(keyboard...)
+}
+
+// sendError tells apart the errors returned by the Bot API. Too many requests
+// come with retry_after, other API errors are permanent. Network errors are
+// returned as is since they may go away on retry
+func sendError(err error) error {
+	if os.IsNotExist(err) {
+		return &SendError{
+			Err: err,
+			Permanent: true,
+		}
+	}
+
+	apiErr, ok := err.(tgbotapi.Error)
+	if !ok {
+		return uploadError(err)
+	}
+
+	if apiErr.RetryAfter > 0 {
+		return &SendError{
+			Err: err,
+			RetryAfter: time.Duration(apiErr.RetryAfter) * time.Second,
+		}
+	}
+
+	return &SendError{
+		Err: err,
+		Permanent: true,
+	}
+}
+
+var retryAfterDescription = regexp.MustCompile(`^Too Many Requests: retry after (\d+)`)
+
+// uploadError recognizes the errors of the Bot API in uploads of files,
+// which come as bare descriptions without the error parameters
+func uploadError(err error) error {
+	if m := retryAfterDescription.FindStringSubmatch(err.Error()); m != nil {
+		seconds, _ := strconv.Atoi(m[1])
+		return &SendError{
+			Err: err,
+			RetryAfter: time.Duration(seconds) * time.Second,
+		}
+	}
+
+	for _, prefix := range []string{"Bad Request:", "Forbidden:", "Unauthorized"} {
+		if strings.HasPrefix(err.Error(), prefix) {
+			return &SendError{
+				Err: err,
+				Permanent: true,
+			}
+		}
+	}
+
+	return err
+}
+
+func fullName(u tgbotapi.User) string {
+	return strings.TrimSpace(fmt.Sprintf("%s %s", u.FirstName, u.LastName))
+}
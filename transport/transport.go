@@ -0,0 +1,68 @@
+package transport
+
+import (
+	"strings"
+	"time"
+)
+
+// Transport delivers messages of the chats to the game and
+// the messages of the game back to the chats
+type Transport interface {
+	Messages() <-chan Message
+	Output(chatID string) Output
+	SelfName() string
+}
+
+type Message struct {
+	// ID of the message in the chat
+	ID int
+	ChatID string
+	Text string
+	SenderName string
+	// CallbackID is set when the message is a press of a button. The text is the data of the button
+	// and the ID is of the message with the keyboard
+	CallbackID string
+	// Location is set when the player shares a location. Live is set for the updates
+	// of a live location, they come every time the player moves
+	Location *Point
+	Live bool
+}
+
+// Acknowledger is implemented by transports with keyboards. Acknowledge shows the player
+// that the press of the button is received, the text is shown briefly if supported
+type Acknowledger interface {
+	Acknowledge(press Message, text string) error
+}
+
+// Command is the name of the command the message starts with, if any.
+// The bot mention in commands like /start@quest_bot is dropped
+func (m Message) Command() string {
+	if !strings.HasPrefix(m.Text, "/") {
+		return ""
+	}
+
+	cmd := strings.Fields(m.Text[1:])
+	if len(cmd) == 0 {
+		return ""
+	}
+
+	return strings.SplitN(cmd[0], "@", 2)[0]
+}
+
+// SendError is returned by writers of transports when they know
+// whether the failed message may be delivered later
+type SendError struct {
+	Err error
+	// RetryAfter is how long the transport asks to wait before the next attempt
+	RetryAfter time.Duration
+	// Permanent errors never go away on retry, e.g. the bot is blocked by the user
+	Permanent bool
+}
+
+func (e *SendError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
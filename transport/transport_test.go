@@ -0,0 +1,130 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommand(t *testing.T) {
+	assert.Equal(t, "philadelphia", Message{Text: "/philadelphia"}.Command())
+	assert.Equal(t, "a", Message{Text: "/a some answer"}.Command())
+	assert.Equal(t, "start", Message{Text: "/start@quest_bot"}.Command())
+	assert.Equal(t, "", Message{Text: "just text"}.Command())
+	assert.Equal(t, "", Message{Text: "/"}.Command())
+}
+
+func TestConsoleMessages(t *testing.T) {
+	in := strings.NewReader("/philadelphia\n\n@2 /adminsecret\n/a answer 1\n[Paris]\n[location: 55.7539, 37.6208]\n")
+	c := NewConsole(in, bytes.NewBuffer(nil))
+
+	var msgs []Message
+	for m := range c.Messages() {
+		msgs = append(msgs, m)
+	}
+
+	assert.Equal(t, 5, len(msgs))
+	assert.Equal(t, Message{ChatID: ConsoleChatID, Text: "/philadelphia", SenderName: "Player 1"}, msgs[0])
+	assert.Equal(t, Message{ChatID: "2", Text: "/adminsecret", SenderName: "Player 2"}, msgs[1])
+	assert.Equal(t, ConsoleChatID, msgs[2].ChatID)
+	assert.Equal(t, "/a answer 1", msgs[2].Text)
+	assert.Equal(t, Message{ChatID: ConsoleChatID, Text: "Paris", SenderName: "Player 1", CallbackID: "console"}, msgs[3], "must press the button")
+	assert.Equal(t, &Point{Latitude: 55.7539, Longitude: 37.6208}, msgs[4].Location, "must share the location")
+	assert.Equal(t, "", msgs[4].Text)
+}
+
+func TestConsoleOutput(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	c := NewConsole(strings.NewReader(""), out)
+
+	err := c.Output("1").Send(Outgoing{Text: "Welcome to Mission 1"})
+	assert.NoError(t, err)
+
+	c.Output("2").Send(Outgoing{
+		Text: "Hello, admin",
+		Keyboard: [][]Button{{{Text: "yes", Data: "y"}, {Text: "no", Data: "n"}}},
+	})
+
+	assert.Equal(t, "[1] Welcome to Mission 1\n[2] Hello, admin\n[yes] [no]\n", out.String())
+}
+
+func TestSendError(t *testing.T) {
+	tooMany := sendError(tgbotapi.Error{
+		Message: "Too Many Requests: retry after 3",
+		ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 3},
+	})
+	assert.Equal(t, &SendError{
+		Err: tgbotapi.Error{Message: "Too Many Requests: retry after 3", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 3}},
+		RetryAfter: 3 * time.Second,
+	}, tooMany)
+
+	blocked := sendError(tgbotapi.Error{Message: "Forbidden: bot was blocked by the user"})
+	assert.True(t, blocked.(*SendError).Permanent)
+
+	reset := errors.New("connection reset by peer")
+	assert.Equal(t, reset, sendError(reset))
+}
+
+func TestEscape(t *testing.T) {
+	assert.Equal(t, "a <b> & *c*", Escape("a <b> & *c*", PlainText))
+	assert.Equal(t, "a &lt;b&gt; &amp; *c*", Escape("a <b> & *c*", HTML))
+	assert.Equal(t, "\\_a\\_ \\*b\\* \\`c\\` \\[d]", Escape("_a_ *b* `c` [d]", Markdown))
+	assert.Equal(t, "Mr\\. \\*Smith\\* \\(1\\-2\\)\\!", Escape("Mr. *Smith* (1-2)!", MarkdownV2))
+}
+
+type recordingOutput struct {
+	msgs []Outgoing
+}
+
+func (o *recordingOutput) Send(msg Outgoing) error {
+	o.msgs = append(o.msgs, msg)
+	return nil
+}
+
+func TestWriterOutput(t *testing.T) {
+	bridge := Outgoing{
+		Text: "<b>the bridge</b>",
+		ParseMode: HTML,
+		Media: &Media{Type: Photo, File: "quests/img/bridge.jpg"},
+	}
+
+	plain := bytes.NewBuffer(nil)
+	assert.NoError(t, WriterOutput(plain).Send(bridge))
+	assert.Equal(t, "[photo: bridge.jpg]\n<b>the bridge</b>", plain.String())
+
+	both := &struct {
+		bytes.Buffer
+		recordingOutput
+	}{}
+	assert.NoError(t, WriterOutput(both).Send(bridge))
+	assert.Equal(t, []Outgoing{bridge}, both.msgs, "writers which are outputs must be used as is")
+	assert.Equal(t, "", both.String())
+}
+
+func TestOutgoingString(t *testing.T) {
+	assert.Equal(t, "task 1", Outgoing{Text: "task 1"}.String())
+	assert.Equal(t, "[location: 55.7539, 37.6208]", Outgoing{
+		Media: &Media{Type: Location, Latitude: 55.7539, Longitude: 37.6208},
+	}.String())
+	assert.Equal(t, "\\[audio: riddle\\.mp3\\]\nListen", Outgoing{
+		Text: "Listen",
+		ParseMode: MarkdownV2,
+		Media: &Media{Type: Audio, File: "riddle.mp3"},
+	}.String())
+}
+
+func TestUploadError(t *testing.T) {
+	err := sendError(errors.New("Too Many Requests: retry after 5"))
+	assert.Equal(t, 5 * time.Second, err.(*SendError).RetryAfter)
+
+	err = sendError(errors.New("Bad Request: wrong file"))
+	assert.True(t, err.(*SendError).Permanent)
+
+	_, notExist := os.Open("./no/such/file.jpg")
+	assert.True(t, sendError(notExist).(*SendError).Permanent)
+}
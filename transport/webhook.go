@@ -0,0 +1,160 @@
+package transport
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+type WebhookConfig struct {
+	// URL is the public address Telegram sends updates to,
+	// e.g. the address of the reverse proxy
+	URL string
+	// Listen is the local address of the HTTP server, e.g. ":8080"
+	Listen string
+	// SecretToken is sent by Telegram with every update, it is required.
+	// Requests without the token are rejected
+	SecretToken string
+	// CertFile and KeyFile make the server use TLS. Leave them
+	// empty if TLS is terminated by the reverse proxy
+	CertFile string
+	KeyFile string
+	// SelfSigned uploads CertFile to Telegram along with the webhook,
+	// Telegram does not trust a self-signed certificate otherwise
+	SelfSigned bool
+}
+
+// NewTelegramWebhook starts an HTTP server which receives updates
+// from Telegram and registers its URL as the webhook of the bot
+func NewTelegramWebhook(bot *tgbotapi.BotAPI, conf WebhookConfig) (*Telegram, error) {
+	hookURL, err := url.Parse(conf.URL)
+	if err != nil {
+		return nil, err
+	}
+	if hookURL.Scheme == "" || hookURL.Host == "" {
+		return nil, errors.New("webhook URL must be absolute: " + conf.URL)
+	}
+	// anyone who finds the URL could play for the users otherwise
+	if conf.SecretToken == "" {
+		return nil, errors.New("webhook secret token is required")
+	}
+
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		return nil, errors.New("both certificate and key files are required for TLS")
+	}
+	if conf.SelfSigned && conf.CertFile == "" {
+		return nil, errors.New("self-signed certificate file is required")
+	}
+
+	l, err := net.Listen("tcp", conf.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	updates := make(chan tgbotapi.Update, bot.Buffer)
+
+	path := hookURL.Path
+	if path == "" {
+		path = "/"
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, &webhookHandler{
+		secret: conf.SecretToken,
+		updates: updates,
+	})
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		var err error
+		if conf.CertFile != "" {
+			err = srv.ServeTLS(l, conf.CertFile, conf.KeyFile)
+		} else {
+			err = srv.Serve(l)
+		}
+
+		if err != nil && err != http.ErrServerClosed {
+			log.Println("webhook server stopped:", err)
+		}
+	}()
+
+	if err := setWebhook(bot, hookURL, conf); err != nil {
+		srv.Close()
+		return nil, err
+	}
+
+	t := &Telegram{
+		bot: bot,
+		messages: make(chan Message),
+		stop: func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+			defer cancel()
+
+			// handlers may still send updates if the server did not shut down in time
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Println(err)
+				return
+			}
+			close(updates)
+		},
+	}
+
+	go t.receive(updates)
+
+	return t, nil
+}
+
+func setWebhook(bot *tgbotapi.BotAPI, hookURL *url.URL, conf WebhookConfig) error {
+	params := map[string]string{
+		"url": hookURL.String(),
+		"secret_token": conf.SecretToken,
+	}
+
+	if conf.SelfSigned {
+		_, err := bot.UploadFile("setWebhook", params, "certificate", conf.CertFile)
+		return err
+	}
+
+	values := url.Values{}
+	for k, v := range params {
+		values.Set(k, v)
+	}
+
+	_, err := bot.MakeRequest("setWebhook", values)
+	return err
+}
+
+type webhookHandler struct {
+	secret string
+	updates chan tgbotapi.Update
+}
+
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.Header.Get(secretTokenHeader)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.secret)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var update tgbotapi.Update
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	h.updates <- update
+}